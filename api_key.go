@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tenantsPrefix prefixes the keys of the objects uploaded with an API key, as
+// tenants/{key id}/{key}.
+const tenantsPrefix = "tenants/"
+
+// apiKeys maps the hex encoded SHA-256 of the API keys to their settings. nil disables the
+// authentication.
+var apiKeys map[string]apiKey
+
+type apiKey struct {
+	ID         string `json:"id"`
+	SHA256     string `json:"sha256"`
+	DailyQuota int64  `json:"dailyQuota"` // Bytes uploaded per UTC day, zero for no quota.
+}
+
+type apiKeyContextKey struct{}
+
+// loadAPIKeys reads the JSON array of API keys of API_KEYS_FILE. Only the SHA-256 of the keys
+// is stored, so that the file does not hold them.
+func loadAPIKeys(name string) (map[string]apiKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var keys []apiKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid API_KEYS_FILE %q: %v", name, err)
+	}
+	ids := make(map[string]bool, len(keys))
+	byHash := make(map[string]apiKey, len(keys))
+	for _, key := range keys {
+		key.SHA256 = strings.ToLower(key.SHA256)
+		if !validKeyID(key.ID) || ids[key.ID] {
+			return nil, fmt.Errorf("invalid or repeated API key id %q", key.ID)
+		}
+		if sum, err := hex.DecodeString(key.SHA256); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 of API key %q", key.ID)
+		}
+		if key.DailyQuota < 0 {
+			return nil, fmt.Errorf("invalid dailyQuota of API key %q", key.ID)
+		}
+		ids[key.ID] = true
+		byHash[key.SHA256] = key
+	}
+	return byHash, nil
+}
+
+// validKeyID reports whether the API key id can be part of object keys: 1 to 64 lowercase
+// letters, digits, dashes and underscores.
+func validKeyID(id string) bool {
+	return id != "" && len(id) <= 64 && strings.Trim(id, "abcdefghijklmnopqrstuvwxyz0123456789-_") == ""
+}
+
+// authenticate rejects the requests without a known API key, sent as "Authorization: Bearer
+// {key}" or "X-API-Key: {key}", with 401, and the uploads of keys past their daily quota with
+// 429. Every request sending a body with POST, PUT or PATCH counts towards the quota. It passes every request through when no API key is configured.
+func authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKeys == nil {
+			next(w, r)
+			return
+		}
+		secret := r.Header.Get("X-API-Key")
+		if scheme, credentials, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+			secret = strings.TrimSpace(credentials)
+		}
+		sum := sha256.Sum256([]byte(secret))
+		key, ok := apiKeys[hex.EncodeToString(sum[:])]
+		if secret == "" || !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or unknown API key")
+			return
+		}
+		if key.DailyQuota > 0 && (r.Method == http.MethodPost || r.Method == http.MethodPut || r.Method == http.MethodPatch) {
+			if used := quotas.used(key.ID); used >= key.DailyQuota || (r.ContentLength > 0 && used+r.ContentLength > key.DailyQuota) {
+				writeError(w, http.StatusTooManyRequests, "quota_exceeded", "daily upload quota exceeded")
+				return
+			}
+			r.Body = &quotaReader{ReadCloser: r.Body, id: key.ID}
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key)))
+	}
+}
+
+// requestAPIKey returns the API key the request was authenticated with.
+func requestAPIKey(r *http.Request) (apiKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey{}).(apiKey)
+	return key, ok
+}
+
+// keyPrefix returns the prefix of the keys of the objects uploaded by the request, empty
+// without an API key.
+func keyPrefix(r *http.Request) string {
+	if key, ok := requestAPIKey(r); ok {
+		return tenantsPrefix + key.ID + "/"
+	}
+	return ""
+}
+
+// ownsKey reports whether the request may access the object stored under key. Keys with "." or
+// ".." segments or backslashes are never owned, as the filesystem storage resolves them to the
+// keys of other tenants.
+func ownsKey(r *http.Request, key string) bool {
+	if strings.ContainsRune(key, '\\') {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return strings.HasPrefix(key, keyPrefix(r))
+}
+
+// trimTenantPrefix returns the key without its tenant prefix, if it has a valid one.
+func trimTenantPrefix(key string) string {
+	if !strings.HasPrefix(key, tenantsPrefix) {
+		return key
+	}
+	id, rest, ok := strings.Cut(strings.TrimPrefix(key, tenantsPrefix), "/")
+	if !ok || !validKeyID(id) {
+		return key
+	}
+	return rest
+}
+
+// byteQuotas counts the bytes uploaded by each API key during the current UTC day. Each
+// instance counts its own uploads.
+type byteQuotas struct {
+	mu    sync.Mutex
+	day   string
+	bytes map[string]int64
+}
+
+var quotas = &byteQuotas{bytes: make(map[string]int64)}
+
+// reset starts a new count when the day changed. The caller holds the lock.
+func (q *byteQuotas) reset() {
+	if day := time.Now().UTC().Format("2006-01-02"); day != q.day {
+		q.day = day
+		q.bytes = make(map[string]int64)
+	}
+}
+
+func (q *byteQuotas) used(id string) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reset()
+	return q.bytes[id]
+}
+
+func (q *byteQuotas) add(id string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reset()
+	q.bytes[id] += n
+}
+
+// quotaReader counts the bytes read from a request body against the quota of an API key. The
+// quota is checked when requests start, so uploads in flight may exceed it.
+type quotaReader struct {
+	io.ReadCloser
+	id string
+}
+
+func (r *quotaReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	quotas.add(r.id, int64(n))
+	return n, err
+}
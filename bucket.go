@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// bucketRoute stores objects whose content type starts with prefix in bucket.
+type bucketRoute struct {
+	prefix string
+	bucket string
+}
+
+// parseBucketRoutes parses a comma separated list of prefix=bucket pairs, e.g.
+// "image/*=bucket-a,video/*=bucket-b". A trailing "*" in the prefix is optional.
+func parseBucketRoutes(s string) ([]bucketRoute, error) {
+	var routes []bucketRoute
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		prefix, bucket, ok := strings.Cut(pair, "=")
+		prefix = strings.TrimSuffix(strings.TrimSpace(prefix), "*")
+		bucket = strings.TrimSpace(bucket)
+		if !ok || prefix == "" || bucket == "" {
+			return nil, fmt.Errorf("invalid bucket route %q", pair)
+		}
+		routes = append(routes, bucketRoute{prefix: prefix, bucket: bucket})
+	}
+	return routes, nil
+}
+
+// resolveBucket returns the bucket of the longest route prefix matching the content type,
+// or the default bucket when no route matches.
+func resolveBucket(contentType string) string {
+	resolved, longest := bucket, 0
+	for _, route := range bucketRoutes {
+		if strings.HasPrefix(contentType, route.prefix) && len(route.prefix) > longest {
+			resolved, longest = route.bucket, len(route.prefix)
+		}
+	}
+	return resolved
+}
+
+// knownBucket reports whether uploads may be stored in the bucket.
+func knownBucket(name string) bool {
+	if name == bucket {
+		return true
+	}
+	for _, route := range bucketRoutes {
+		if name == route.bucket {
+			return true
+		}
+	}
+	return false
+}
+
+// buckets returns the bucket and the buckets of the routes, without duplicates.
+func buckets() []string {
+	names := []string{bucket}
+	for _, route := range bucketRoutes {
+		duplicate := false
+		for _, name := range names {
+			duplicate = duplicate || name == route.bucket
+		}
+		if !duplicate {
+			names = append(names, route.bucket)
+		}
+	}
+	return names
+}
@@ -0,0 +1,38 @@
+package main
+
+import "sync"
+
+// bufferSizeClasses are the capacities of the pooled part buffers, from smallest to largest.
+var bufferSizeClasses = []int64{
+	1024 * 1024 * 5,  // 5 MB, the minimum part size.
+	1024 * 1024 * 16, // 16 MB
+	1024 * 1024 * 64, // 64 MB
+}
+
+var bufferPools = make([]sync.Pool, len(bufferSizeClasses))
+
+// getBuffer returns a zero length buffer with capacity for at least size bytes, taken from
+// the smallest size class that fits. Sizes above the largest class are not pooled.
+func getBuffer(size int64) []byte {
+	for i, class := range bufferSizeClasses {
+		if size <= class {
+			if b, ok := bufferPools[i].Get().(*[]byte); ok {
+				return (*b)[:0]
+			}
+			return make([]byte, 0, class)
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+// putBuffer returns a buffer obtained from getBuffer to its pool. Its length is reset, so the
+// previous upload's bytes are never exposed: callers only read what they wrote after getBuffer.
+func putBuffer(b []byte) {
+	for i, class := range bufferSizeClasses {
+		if int64(cap(b)) == class {
+			b = b[:0]
+			bufferPools[i].Put(&b)
+			return
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestGetBuffer(t *testing.T) {
+	tests := []struct {
+		size    int64
+		wantCap int
+	}{
+		{size: 1, wantCap: 1024 * 1024 * 5},
+		{size: 1024 * 1024 * 5, wantCap: 1024 * 1024 * 5},
+		{size: 1024*1024*5 + 1, wantCap: 1024 * 1024 * 16},
+		{size: 1024 * 1024 * 64, wantCap: 1024 * 1024 * 64},
+		{size: 1024*1024*64 + 1, wantCap: 1024*1024*64 + 1},
+	}
+	for _, test := range tests {
+		b := getBuffer(test.size)
+		if len(b) != 0 || cap(b) != test.wantCap {
+			t.Errorf("getBuffer(%d) has length %d and capacity %d, want 0 and %d", test.size, len(b), cap(b), test.wantCap)
+		}
+		putBuffer(b)
+	}
+}
+
+func TestPutBufferResetsLength(t *testing.T) {
+	b := append(getBuffer(1), "previous upload"...)
+	putBuffer(b)
+	if b := getBuffer(1); len(b) != 0 {
+		t.Errorf("got a buffer of length %d, want 0", len(b))
+	}
+}
+
+// partData is the contents of the parts the benchmarks buffer.
+var partData = bytes.Repeat([]byte("x"), int(minUploadPartSize))
+
+// BenchmarkPartBuffer and BenchmarkPartBufferUnpooled compare the allocations of filling whole
+// parts, as the memory part reader does, in pooled buffers and in new ones, from concurrent
+// uploads.
+func BenchmarkPartBuffer(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(minUploadPartSize)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buffer := getBuffer(minUploadPartSize)
+			if _, err := io.ReadFull(bytes.NewReader(partData), buffer[:minUploadPartSize]); err != nil {
+				b.Error(err)
+			}
+			putBuffer(buffer)
+		}
+	})
+}
+
+func BenchmarkPartBufferUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	b.SetBytes(minUploadPartSize)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buffer := make([]byte, minUploadPartSize)
+			if _, err := io.ReadFull(bytes.NewReader(partData), buffer); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const chunksPath = "/api/v1/chunks"
+
+// contentRange is a parsed "bytes <start>-<end>/<size>" Content-Range header.
+type contentRange struct {
+	start, end, size int64
+}
+
+func parseContentRange(s string) (contentRange, error) {
+	var cr contentRange
+	if !strings.HasPrefix(s, "bytes ") {
+		return cr, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	byteRange, size, ok := strings.Cut(strings.TrimPrefix(s, "bytes "), "/")
+	start, end, ok2 := strings.Cut(byteRange, "-")
+	if !ok || !ok2 {
+		return cr, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	var err1, err2, err3 error
+	cr.start, err1 = strconv.ParseInt(start, 10, 64)
+	cr.end, err2 = strconv.ParseInt(end, 10, 64)
+	cr.size, err3 = strconv.ParseInt(size, 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || cr.start < 0 || cr.end < cr.start || cr.end >= cr.size {
+		return cr, fmt.Errorf("invalid Content-Range %q", s)
+	}
+	return cr, nil
+}
+
+// chunkHandler serves PUT /api/v1/chunks/{id}, where each request carries the next range of a
+// body, as declared by its Content-Range header. Ranges must be contiguous, and each one is
+// stored as the next parts of a multipart upload, which is completed with the final range.
+// Every range but the final one must hold at least the minimum part size. A final range whose
+// upload could not be completed may be sent again.
+func chunkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, chunksPath+"/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "not_found", "no such chunked upload")
+		return
+	}
+	// The IDs chosen by the clients of different API keys do not collide.
+	id = keyPrefix(r) + id
+	cr, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil || r.ContentLength != cr.end-cr.start+1 || cr.size > maxContentSize {
+		writeError(w, http.StatusBadRequest, "invalid_content_range", "invalid Content-Range")
+		return
+	}
+	final := cr.end+1 == cr.size
+	if !final && r.ContentLength < minUploadPartSize {
+		writeError(w, http.StatusBadRequest, "chunk_too_small", "every chunk but the last must be at least 5 MB")
+		return
+	}
+	ctx := r.Context()
+	var body io.Reader = r.Body
+	session, ok, err := chunkedSessions.acquire(id)
+	if errors.Is(err, errSessionBusy) {
+		writeError(w, http.StatusConflict, "session_busy", "another chunk of the upload is being received")
+		return
+	}
+	if !ok {
+		if cr.start != 0 {
+			writeError(w, http.StatusBadRequest, "invalid_content_range", "the first chunk must start at byte 0")
+			return
+		}
+		contentType := normalizeContentType(r.Header.Get("Content-Type"))
+		if !acceptedContentType(contentType, contentTypes["/api/v1/file"]) {
+			writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "unsupported content type")
+			return
+		}
+		encryption, err := requestEncryption(r)
+		if err != nil {
+			writeEncryptionError(w, err)
+			return
+		}
+		if rejectsVideo(contentType, encryption) {
+			writeError(w, http.StatusUnprocessableEntity, "poster_unavailable", "a poster cannot be extracted from the video")
+			return
+		}
+		metadata, err := requestMetadata(r.Header)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+			return
+		}
+		lock, hints, tags, ok := requestRetention(w, r)
+		if !ok {
+			return
+		}
+		if writeShed(w) {
+			return
+		}
+		session.ID = id
+		session.Bucket = resolveBucket(contentType)
+		session.Key = keyPrefix(r) + newKey(contentType)
+		session.ContentType = contentType
+		session.Size = cr.size
+		session.Metadata = metadata
+		session.LifecycleHints = hints
+		session.Tags = tags
+		session.setEncryption(r, encryption)
+		session.ExpiresAt = time.Now().Add(sessionTTL)
+		if !chunkedSessions.create(session) {
+			writeError(w, http.StatusConflict, "session_exists", "the chunked upload already exists")
+			return
+		}
+		multipartUploadOutput, err := storage.CreateUpload(ctx, newCreateMultipartUploadInput(session.Bucket, session.Key, contentType,
+			withEncryption(encryption),
+			withObjectLock(lock),
+			withStorageClass(defaultStorageClass),
+			withTags(hints, tags),
+			withMetadata(metadata),
+		))
+		if err != nil {
+			chunkedSessions.delete(id)
+			writeS3Error(w, r, err)
+			return
+		}
+		session.UploadID = *multipartUploadOutput.UploadId
+	}
+	defer func() {
+		if _, ok := chunkedSessions.get(id); ok {
+			chunkedSessions.release(session)
+		}
+	}()
+	encryption, err := sessionEncryption(r, session)
+	if err != nil {
+		writeEncryptionError(w, err)
+		return
+	}
+	// Gaps and overlaps with the ranges received so far are rejected.
+	if cr.start != session.Offset || cr.size != session.Size {
+		if session.Offset > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", session.Offset-1))
+		}
+		writeError(w, http.StatusBadRequest, "invalid_content_range", "the range does not follow the received bytes")
+		return
+	}
+	// The first chunk must look like the declared type, the sniffed bytes are still uploaded. It
+	// is checked again when it is sent again after being cut off or failing.
+	if session.Offset == 0 {
+		var sniffed string
+		sniffed, body, err = sniffBody(r.Body)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		if !matchesSniffed(session.ContentType, sniffed, contentTypes["/api/v1/file"]) {
+			logEntry(r.Context(), logLevelInfo, "content type mismatch", "declared", session.ContentType, "sniffed", sniffed)
+			writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "contents do not match the content type")
+			return
+		}
+	}
+	// The chunk is split into parts of the part size, the last one taking the remainder, so that
+	// every part but the last of the upload holds at least 5 MB.
+	count := r.ContentLength / partSize
+	if count == 0 {
+		count = 1
+	}
+	if int64(len(session.Parts))+count > maxPartNumber {
+		writeError(w, http.StatusRequestEntityTooLarge, "entity_too_large", "too many chunks")
+		return
+	}
+	session.ExpiresAt = time.Now().Add(sessionTTL)
+	// The parts of the chunk are only added to the session once every one of them is stored, and
+	// the upload completed for the final chunk, so that a chunk cut off or failing is sent again
+	// whole, its parts replacing the ones stored the first time.
+	deadline := withDeadline(throttle(r.Context(), body))
+	parts := session.Parts[:len(session.Parts):len(session.Parts)]
+	for i := int64(0); i < count; i++ {
+		size := partSize
+		if i == count-1 {
+			size = r.ContentLength - i*partSize
+		}
+		part, err := uploadChunkPart(ctx, session, encryption, int32(len(parts)+1), io.LimitReader(deadline, size), size)
+		if errors.Is(err, errUploadDuration) {
+			logEntry(r.Context(), logLevelInfo, "upload cut off", "error", err, "bytes", deadline.n)
+			writeUploadDuration(w)
+			return
+		} else if errors.Is(err, errIncompleteChunk) {
+			writeError(w, http.StatusBadRequest, "incomplete_chunk", "the chunk is shorter than its Content-Range")
+			return
+		} else if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		parts = append(parts, part)
+	}
+	if !final {
+		session.Parts = parts
+		session.Offset = cr.end + 1
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", cr.end))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	completeMultipartUploadOutput, err := storage.Complete(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(session.Bucket),
+		Key:      aws.String(session.Key),
+		UploadId: aws.String(session.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: parts,
+		},
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	chunkedSessions.delete(id)
+	recentUploads.add(session.Bucket, session.Key)
+	links := []Link{
+		{
+			URL: objectURL(ctx, session.Bucket, session.Key, *completeMultipartUploadOutput.Location),
+		},
+	}
+	poster, err := attachPoster(ctx, session.Bucket, session.Key, *completeMultipartUploadOutput.Location, session.ContentType, encryption)
+	if err != nil {
+		writePosterError(w, r, err)
+		return
+	}
+	if poster != nil {
+		links = append(links, *poster)
+	}
+	links = append(links, notifyUploaded(webhookURL, Notification{
+		Bucket:      session.Bucket,
+		Key:         session.Key,
+		ContentType: session.ContentType,
+		Size:        session.Size,
+		Metadata:    session.Metadata,
+		Links:       links,
+	})...)
+	writeMessage(w, r, http.StatusCreated, Message{
+		Bucket:         session.Bucket,
+		Key:            session.Key,
+		Links:          links,
+		LifecycleHints: session.LifecycleHints,
+		Tags:           session.Tags,
+		Metadata:       session.Metadata,
+		Size:           session.Size,
+		VersionID:      aws.ToString(completeMultipartUploadOutput.VersionId),
+	})
+}
+
+var errIncompleteChunk = errors.New("incomplete chunk")
+
+// uploadChunkPart uploads the size bytes of body as the part of the chunked upload numbered
+// partNumber, replacing the part sent before under that number, if any.
+func uploadChunkPart(ctx context.Context, session session, encryption encryption, partNumber int32, body io.Reader, size int64) (types.CompletedPart, error) {
+	partReader, err := newPartReader(partReaderStrategy, body, size)
+	if err != nil {
+		return types.CompletedPart{}, err
+	}
+	defer partReader.Close()
+	part, err := partReader.NextPart()
+	defer part.Release()
+	if err != nil {
+		return types.CompletedPart{}, err
+	}
+	if part.Size != size {
+		return types.CompletedPart{}, fmt.Errorf("%w: %d of %d bytes", errIncompleteChunk, part.Size, size)
+	}
+	partMD5, err := contentMD5(part.Body)
+	if err != nil {
+		return types.CompletedPart{}, err
+	}
+	uploadPartOutput, err := uploadPartWithRetries(ctx, &s3.UploadPartInput{
+		Bucket:               aws.String(session.Bucket),
+		Key:                  aws.String(session.Key),
+		PartNumber:           partNumber,
+		UploadId:             aws.String(session.UploadID),
+		Body:                 part.Body,
+		ContentLength:        part.Size,
+		ContentMD5:           aws.String(partMD5),
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	if err != nil {
+		return types.CompletedPart{}, err
+	}
+	return types.CompletedPart{
+		ETag:       uploadPartOutput.ETag,
+		PartNumber: partNumber,
+	}, nil
+}
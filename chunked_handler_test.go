@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseContentRange(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    contentRange
+		wantErr bool
+	}{
+		{header: "bytes 0-4/5", want: contentRange{start: 0, end: 4, size: 5}},
+		{header: "bytes 5242880-10485759/20971520", want: contentRange{start: 5242880, end: 10485759, size: 20971520}},
+		{header: "bytes 9-9/10", want: contentRange{start: 9, end: 9, size: 10}},
+		{header: "", wantErr: true},
+		{header: "0-4/5", wantErr: true},
+		{header: "items 0-4/5", wantErr: true},
+		{header: "bytes 0-4", wantErr: true},
+		{header: "bytes 0/5", wantErr: true},
+		{header: "bytes 0-4/*", wantErr: true},
+		{header: "bytes */5", wantErr: true},
+		{header: "bytes -1-4/5", wantErr: true},
+		{header: "bytes 4-0/5", wantErr: true},
+		{header: "bytes 0-5/5", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseContentRange(test.header)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseContentRange(%q) = %+v, want an error", test.header, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseContentRange(%q): %v", test.header, err)
+		} else if got != test.want {
+			t.Errorf("parseContentRange(%q) = %+v, want %+v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestChunkHandlerChecksRetriedFirstChunk(t *testing.T) {
+	defer func(s Storage, b string, size, maxSize int64, presign bool) {
+		storage, bucket, partSize, maxContentSize, presignLinks = s, b, size, maxSize, presign
+	}(storage, bucket, partSize, maxContentSize, presignLinks)
+	storage = filesystemStorage{dir: t.TempDir()}
+	bucket, partSize, maxContentSize, presignLinks = "bucket", minUploadPartSize, minUploadPartSize, false
+	genuine := pngHeader + strings.Repeat("x", 100)
+	spoofed := "<html>" + strings.Repeat("x", len(genuine)-6)
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+	}{
+		{name: "cut off", body: genuine[:20], statusCode: http.StatusBadRequest},
+		{name: "spoofed retry", body: spoofed, statusCode: http.StatusUnsupportedMediaType},
+		{name: "genuine retry", body: genuine, statusCode: http.StatusCreated},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPut, chunksPath+"/retried", strings.NewReader(test.body))
+		r.ContentLength = int64(len(genuine))
+		r.Header.Set("Content-Type", "image/png")
+		r.Header.Set("Content-Range", fmt.Sprintf("bytes 0-%d/%d", len(genuine)-1, len(genuine)))
+		w := httptest.NewRecorder()
+		chunkHandler(w, r)
+		if w.Code != test.statusCode {
+			t.Fatalf("%s: got status %d, want %d: %s", test.name, w.Code, test.statusCode, w.Body)
+		}
+	}
+}
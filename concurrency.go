@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadsRetryAfter is the Retry-After answered to the uploads rejected while every upload slot
+// is taken.
+const uploadsRetryAfter = 5 * time.Second
+
+// uploadSlots holds a token per upload being received, nil when MAX_CONCURRENT_UPLOADS is not
+// set. Each upload buffers its parts and holds connections to Amazon S3, so bounding them bounds
+// the memory of a burst of uploads.
+var uploadSlots chan struct{}
+
+// limitUploads rejects the requests sending a body to the upload routes with 503 while
+// MAX_CONCURRENT_UPLOADS of them are being received, instead of queueing them.
+func limitUploads(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if uploadSlots == nil || (r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch) {
+			next(w, r)
+			return
+		}
+		select {
+		case uploadSlots <- struct{}{}:
+			defer func() { <-uploadSlots }()
+			next(w, r)
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(int(uploadsRetryAfter.Seconds())))
+			writeError(w, http.StatusServiceUnavailable, "overloaded", "too many uploads in progress, retry later")
+		}
+	}
+}
+
+// clientRate is nil when RATE_LIMIT_PER_IP is not set.
+var clientRate *clientLimits
+
+// trustForwardedFor identifies clients by the last address of X-Forwarded-For, the one added by
+// the load balancer in front of the service, rather than by the address of the connection.
+var trustForwardedFor bool
+
+// clientLimits limits the requests of each client IP address with its own token bucket, holding
+// up to one second of requests.
+type clientLimits struct {
+	rate float64 // Requests per second.
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newClientLimits(rate float64) *clientLimits {
+	return &clientLimits{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a request from the bucket of the client, and reports whether it had one left.
+func (l *clientLimits) allow(ip string) bool {
+	l.mu.Lock()
+	bucket, ok := l.buckets[ip]
+	if !ok {
+		bucket = newTokenBucket(l.rate)
+		l.buckets[ip] = bucket
+	}
+	l.mu.Unlock()
+	return bucket.take(1)
+}
+
+// sweep forgets the clients idle since before t, whose buckets are full again.
+func (l *clientLimits) sweep(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for ip, bucket := range l.buckets {
+		if bucket.idleSince().Add(time.Second).Before(t) {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// sweepClientLimits forgets the idle clients at each interval.
+func sweepClientLimits(ctx context.Context, interval time.Duration, limits *clientLimits) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			limits.sweep(t)
+		}
+	}
+}
+
+// clientIP returns the IP address identifying the client of the request.
+func clientIP(r *http.Request) string {
+	if trustForwardedFor {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(addresses[len(addresses)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitClients answers 429 to the requests of the clients past RATE_LIMIT_PER_IP, so that a
+// single client cannot take every upload slot.
+func limitClients(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if clientRate != nil && !clientRate.allow(clientIP(r)) {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusTooManyRequests, "rate_limited", "too many requests, retry later")
+			return
+		}
+		next(w, r)
+	}
+}
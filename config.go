@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// serviceConfig holds the settings every upload depends on, read once at startup.
+type serviceConfig struct {
+	bucket         string
+	region         string // Empty leaves the region to the default AWS configuration.
+	partSize       int64
+	maxContentSize int64
+}
+
+// loadConfig reads the service configuration with getenv, and rejects missing or invalid values
+// instead of letting them fail the first requests.
+func loadConfig(getenv func(string) string) (serviceConfig, error) {
+	c := serviceConfig{
+		bucket:         getenv("BUCKET"),
+		region:         getenv("AWS_REGION"),
+		partSize:       minUploadPartSize,
+		maxContentSize: 1024 * 1024 * 1000, // 1000 MB
+	}
+	if c.bucket == "" {
+		return serviceConfig{}, errors.New("BUCKET is required")
+	}
+	if v := getenv("PART_SIZE"); v != "" {
+		partSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || partSize < minUploadPartSize || partSize > maxUploadPartSize {
+			return serviceConfig{}, fmt.Errorf("invalid PART_SIZE %q: must be between %d and %d bytes", v, minUploadPartSize, maxUploadPartSize)
+		}
+		c.partSize = partSize
+	}
+	if v := getenv("MAX_CONTENT_SIZE"); v != "" {
+		maxContentSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxContentSize < 1 {
+			return serviceConfig{}, fmt.Errorf("invalid MAX_CONTENT_SIZE %q", v)
+		}
+		c.maxContentSize = maxContentSize
+	}
+	return c, nil
+}
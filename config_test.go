@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		want serviceConfig
+		err  bool
+	}{
+		{
+			name: "defaults",
+			env:  map[string]string{"BUCKET": "bucket"},
+			want: serviceConfig{bucket: "bucket", partSize: minUploadPartSize, maxContentSize: 1024 * 1024 * 1000},
+		},
+		{
+			name: "all set",
+			env:  map[string]string{"BUCKET": "bucket", "AWS_REGION": "eu-west-1", "PART_SIZE": "10485760", "MAX_CONTENT_SIZE": "2048"},
+			want: serviceConfig{bucket: "bucket", region: "eu-west-1", partSize: 10485760, maxContentSize: 2048},
+		},
+		{
+			name: "largest part size",
+			env:  map[string]string{"BUCKET": "bucket", "PART_SIZE": "5368709120"},
+			want: serviceConfig{bucket: "bucket", partSize: maxUploadPartSize, maxContentSize: 1024 * 1024 * 1000},
+		},
+		{name: "missing bucket", env: map[string]string{}, err: true},
+		{name: "part size too small", env: map[string]string{"BUCKET": "bucket", "PART_SIZE": "5242879"}, err: true},
+		{name: "part size too large", env: map[string]string{"BUCKET": "bucket", "PART_SIZE": "5368709121"}, err: true},
+		{name: "part size not a number", env: map[string]string{"BUCKET": "bucket", "PART_SIZE": "5MB"}, err: true},
+		{name: "zero max content size", env: map[string]string{"BUCKET": "bucket", "MAX_CONTENT_SIZE": "0"}, err: true},
+		{name: "negative max content size", env: map[string]string{"BUCKET": "bucket", "MAX_CONTENT_SIZE": "-1"}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := loadConfig(func(key string) string { return test.env[key] })
+			if test.err {
+				if err == nil {
+					t.Errorf("got %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
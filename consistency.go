@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"sync"
+	"time"
+)
+
+// Amazon S3 is strongly consistent, but some S3 compatible stores may briefly answer NoSuchKey
+// right after an object is written. When consistencyWindow is set, reads of objects uploaded
+// within the window are retried with backoff instead of failing immediately.
+var (
+	consistencyWindow time.Duration // Zero disables the retries.
+	recentUploads     = &uploadLog{uploads: make(map[string]time.Time)}
+)
+
+type uploadLog struct {
+	mu      sync.Mutex
+	uploads map[string]time.Time
+}
+
+// add records that the object was just uploaded, forgetting uploads older than the window.
+func (l *uploadLog) add(bucket, key string) {
+	if consistencyWindow == 0 {
+		return
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, t := range l.uploads {
+		if now.Sub(t) > consistencyWindow {
+			delete(l.uploads, k)
+		}
+	}
+	l.uploads[bucket+"/"+key] = now
+}
+
+// uploadedAt returns when the object was uploaded, if that happened within the window.
+func (l *uploadLog) uploadedAt(bucket, key string) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.uploads[bucket+"/"+key]
+	return t, ok && time.Since(t) <= consistencyWindow
+}
+
+// getObjectConsistent calls GetObject, retrying NoSuchKey errors with exponential backoff
+// for objects that were uploaded within the consistency window.
+func getObjectConsistent(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	uploadedAt, recent := recentUploads.uploadedAt(aws.ToString(input.Bucket), aws.ToString(input.Key))
+	backoff := 50 * time.Millisecond
+	for {
+		output, err := storage.Get(ctx, input)
+		var noSuchKey *types.NoSuchKey
+		if !recent || !errors.As(err, &noSuchKey) || time.Since(uploadedAt)+backoff > consistencyWindow {
+			return output, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	copySuffix               = "/copy"
+	maxCopyObjectSize  int64 = 1024 * 1024 * 1024 * 5 // 5 GB, the largest object CopyObject copies.
+	copyPartSize       int64 = 1024 * 1024 * 1024     // 1 GB
+	maxObjectKeyLength       = 1024
+)
+
+type CopyRequest struct {
+	Destination  string `json:"destination"`
+	DeleteSource bool   `json:"deleteSource"`
+}
+
+// copyFile serves POST /api/v1/file/{key}/copy?bucket={bucket}, copying the object to the
+// destination key of the JSON body within its bucket, which defaults to BUCKET, with its
+// content type, metadata, tags, encryption, retention and storage class. Objects encrypted with
+// a customer key need the key in X-Encryption-Key, and are copied with it. "deleteSource"
+// deletes the object once copied, renaming it.
+func copyFile(w http.ResponseWriter, r *http.Request) {
+	if storageBackend != storageS3 {
+		writeError(w, http.StatusNotImplemented, "not_implemented", "copies need the s3 storage")
+		return
+	}
+	key := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, downloadPath), copySuffix)
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		bucketName = bucket
+	}
+	if key == "" || !knownBucket(bucketName) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "missing key or unknown bucket")
+		return
+	}
+	if !validKey(key) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "the key was not generated by an upload")
+		return
+	}
+	if !ownsKey(r, key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	}
+	var request CopyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+	// The destination must have the format of the generated keys too, so that it can be deleted.
+	if request.Destination == "" || len(request.Destination) > maxObjectKeyLength || request.Destination == key || !validKey(request.Destination) || !ownsKey(r, request.Destination) {
+		writeError(w, http.StatusBadRequest, "invalid_destination", "missing, invalid or unowned destination key")
+		return
+	}
+	var encryption encryption
+	if customerKey := r.Header.Get("X-Encryption-Key"); customerKey != "" {
+		var err error
+		encryption, err = parseEncryption(encryptionCustomer, customerKey, "", []string{encryptionCustomer})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_encryption", err.Error())
+			return
+		}
+	}
+	ctx := r.Context()
+	head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	// The destination keeps the encryption of the source.
+	encryption.serverSideEncryption = head.ServerSideEncryption
+	encryption.kmsKeyID = head.SSEKMSKeyId
+	lock := objectLock{mode: head.ObjectLockMode, retainUntil: head.ObjectLockRetainUntilDate}
+	var versionID string
+	if head.ContentLength <= maxCopyObjectSize {
+		versionID, err = copyObject(ctx, bucketName, key, request.Destination, head.ContentLength, encryption, lock, head.StorageClass, nil)
+	} else {
+		versionID, err = copyLargeObject(ctx, bucketName, key, request.Destination, head, encryption, lock)
+	}
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	recentUploads.add(bucketName, request.Destination)
+	// A destination that was overwritten must not be served from the disk cache.
+	forgetObject(bucketName, request.Destination)
+	keys := []string{key}
+	if ffmpegPath != "" && strings.HasPrefix(extensionContentType(path.Ext(key)), "video/") {
+		if _, err := copyObject(ctx, bucketName, posterKey(key), posterKey(request.Destination), 0, encryption, objectLock{}, head.StorageClass, nil); err != nil {
+			log.Print(err)
+		} else {
+			forgetObject(bucketName, posterKey(request.Destination))
+			keys = append(keys, posterKey(key))
+		}
+	}
+	if request.DeleteSource {
+		for _, key := range keys {
+			if err := storage.Delete(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(bucketName),
+				Key:    aws.String(key),
+			}); err != nil {
+				writeS3Error(w, r, err)
+				return
+			}
+			forgetObject(bucketName, key)
+		}
+	}
+	writeMessage(w, r, http.StatusCreated, Message{
+		Bucket: bucketName,
+		Key:    request.Destination,
+		Links: []Link{
+			{
+				URL: downloadPath + request.Destination,
+			},
+		},
+		Size:      head.ContentLength,
+		VersionID: versionID,
+	})
+}
+
+// copyLargeObject copies an object too large for CopyObject with a multipart upload whose parts
+// are copied by UploadPartCopy, returning the version ID of dst. The multipart upload does not
+// copy the content type, metadata and tags of the source, which are set again from head and the
+// tags of the source.
+func copyLargeObject(ctx context.Context, bucket, src, dst string, head *s3.HeadObjectOutput, encryption encryption, lock objectLock) (string, error) {
+	presignedURLs.invalidate(bucket, dst)
+	tags, err := client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(src),
+	})
+	if err != nil {
+		return "", err
+	}
+	tagSet := make(map[string]string, len(tags.TagSet))
+	for _, tag := range tags.TagSet {
+		tagSet[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	multipartUploadOutput, err := storage.CreateUpload(ctx, newCreateMultipartUploadInput(bucket, dst, aws.ToString(head.ContentType),
+		withEncryption(encryption),
+		withObjectLock(lock),
+		withStorageClass(head.StorageClass),
+		withMetadata(head.Metadata),
+		withTags(tagSet),
+	))
+	if err != nil {
+		return "", err
+	}
+	size := head.ContentLength
+	partSize := partSizeFor(size, copyPartSize)
+	parts := make([]types.CompletedPart, 0, expectedParts(size, partSize))
+	for start := int64(0); start < size; start += partSize {
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		partNumber := int32(len(parts) + 1)
+		output, err := client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:                         aws.String(bucket),
+			Key:                            aws.String(dst),
+			UploadId:                       multipartUploadOutput.UploadId,
+			PartNumber:                     partNumber,
+			CopySource:                     aws.String(bucket + "/" + url.PathEscape(src)),
+			CopySourceRange:                aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			CopySourceIfMatch:              head.ETag,
+			CopySourceSSECustomerAlgorithm: encryption.customerAlgorithm,
+			CopySourceSSECustomerKey:       encryption.customerKey,
+			CopySourceSSECustomerKeyMD5:    encryption.customerKeyMD5,
+			SSECustomerAlgorithm:           encryption.customerAlgorithm,
+			SSECustomerKey:                 encryption.customerKey,
+			SSECustomerKeyMD5:              encryption.customerKeyMD5,
+		})
+		if err != nil {
+			abortMultipartUpload(ctx, multipartUploadOutput)
+			return "", err
+		}
+		parts = append(parts, types.CompletedPart{
+			ETag:       output.CopyPartResult.ETag,
+			PartNumber: partNumber,
+		})
+	}
+	completeMultipartUploadOutput, err := storage.Complete(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(dst),
+		UploadId:             multipartUploadOutput.UploadId,
+		MultipartUpload:      &types.CompletedMultipartUpload{Parts: parts},
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	if err != nil {
+		abortMultipartUpload(ctx, multipartUploadOutput)
+		return "", err
+	}
+	return aws.ToString(completeMultipartUploadOutput.VersionId), nil
+}
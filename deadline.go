@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxUploadDuration bounds how long the body of a single upload request is read, however fast
+// it flows. Zero disables the limit.
+var maxUploadDuration time.Duration
+
+var errUploadDuration = errors.New("upload exceeded the maximum duration")
+
+// deadlineReader fails reads once the deadline has passed, counting the bytes read until then.
+type deadlineReader struct {
+	reader   io.Reader
+	deadline time.Time
+	n        int64
+}
+
+// withDeadline returns the body limited to the maximum upload duration, if any.
+func withDeadline(body io.Reader) *deadlineReader {
+	r := &deadlineReader{reader: body}
+	if maxUploadDuration > 0 {
+		r.deadline = time.Now().Add(maxUploadDuration)
+	}
+	return r
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if !r.deadline.IsZero() && time.Now().After(r.deadline) {
+		return 0, errUploadDuration
+	}
+	n, err := r.reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// writeUploadDuration answers an upload cut off by the maximum upload duration.
+func writeUploadDuration(w http.ResponseWriter) {
+	writeError(w, http.StatusRequestTimeout, "upload_timeout", "upload exceeded the maximum duration of "+maxUploadDuration.String())
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Dedup index backends selectable through DEDUP_INDEX.
+const (
+	dedupIndexMemory = "memory"
+	dedupIndexS3     = "s3"
+)
+
+// DedupIndex maps the SHA-256 of uploaded contents to the object storing them.
+//
+// Lookups and additions are not atomic together: two identical uploads running at the same time
+// may both miss and both be stored, in which case the index keeps the last one added. Hits are
+// checked with HeadObject before they are used, so objects deleted since they were indexed are
+// never returned.
+type DedupIndex interface {
+	Lookup(ctx context.Context, hash string) (DedupEntry, bool, error)
+	Add(ctx context.Context, hash string, entry DedupEntry) error
+}
+
+type DedupEntry struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+}
+
+// dedupIndex is nil when deduplication is disabled.
+var dedupIndex DedupIndex
+
+// memoryDedupIndex is a DedupIndex local to the process.
+type memoryDedupIndex struct {
+	mu      sync.Mutex
+	entries map[string]DedupEntry
+}
+
+func newMemoryDedupIndex() *memoryDedupIndex {
+	return &memoryDedupIndex{entries: make(map[string]DedupEntry)}
+}
+
+func (i *memoryDedupIndex) Lookup(_ context.Context, hash string) (DedupEntry, bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	entry, ok := i.entries[hash]
+	return entry, ok, nil
+}
+
+func (i *memoryDedupIndex) Add(_ context.Context, hash string, entry DedupEntry) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.entries[hash] = entry
+	return nil
+}
+
+// s3DedupIndex is a DedupIndex shared by every instance, storing one JSON object per hash
+// under a prefix of a bucket.
+type s3DedupIndex struct {
+	bucket string
+	prefix string
+}
+
+func (i *s3DedupIndex) Lookup(ctx context.Context, hash string) (DedupEntry, bool, error) {
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(i.bucket),
+		Key:    aws.String(path.Join(i.prefix, hash)),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return DedupEntry{}, false, nil
+	} else if err != nil {
+		return DedupEntry{}, false, err
+	}
+	defer output.Body.Close()
+	var entry DedupEntry
+	if err := json.NewDecoder(io.LimitReader(output.Body, 4096)).Decode(&entry); err != nil {
+		return DedupEntry{}, false, err
+	}
+	return entry, true, nil
+}
+
+func (i *s3DedupIndex) Add(ctx context.Context, hash string, entry DedupEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(i.bucket),
+		Key:         aws.String(path.Join(i.prefix, hash)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// lookupDuplicate returns the object already storing the contents with the hash, if any, as
+// the new upload would store them: in the same bucket, with the same storage class, object lock
+// and encryption. A hit stored otherwise is stored again, so that the upload gets what it asked
+// for.
+func lookupDuplicate(ctx context.Context, hash, bucket string, encryption encryption, lock objectLock, storageClass types.StorageClass) (DedupEntry, bool, error) {
+	entry, ok, err := dedupIndex.Lookup(ctx, hash)
+	if err != nil || !ok || entry.Bucket != bucket {
+		return DedupEntry{}, false, err
+	}
+	head, err := storage.Head(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(entry.Bucket),
+		Key:    aws.String(entry.Key),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return DedupEntry{}, false, nil
+	} else if err != nil {
+		return DedupEntry{}, false, err
+	}
+	if !storedAs(head, encryption, lock, storageClass) {
+		return DedupEntry{}, false, nil
+	}
+	return entry, true, nil
+}
+
+// storedAs reports whether the object of head is stored with the storage class, object lock and
+// encryption. Objects without an explicit encryption are encrypted by the bucket default, and
+// the encryption context of SSE-KMS cannot be compared, so those uploads never match.
+func storedAs(head *s3.HeadObjectOutput, encryption encryption, lock objectLock, storageClass types.StorageClass) bool {
+	standard := func(class types.StorageClass) types.StorageClass {
+		if class == "" {
+			return types.StorageClassStandard
+		}
+		return class
+	}
+	if standard(head.StorageClass) != standard(storageClass) {
+		return false
+	}
+	if head.ObjectLockMode != lock.mode {
+		return false
+	}
+	if lock.retainUntil != nil && (head.ObjectLockRetainUntilDate == nil || head.ObjectLockRetainUntilDate.Before(*lock.retainUntil)) {
+		return false
+	}
+	switch {
+	case encryption.kmsContext != nil:
+		return false
+	case encryption.serverSideEncryption == "":
+		return head.ServerSideEncryption == "" || head.ServerSideEncryption == types.ServerSideEncryptionAes256
+	case head.ServerSideEncryption != encryption.serverSideEncryption:
+		return false
+	case encryption.kmsKeyID != nil:
+		keyID := aws.ToString(head.SSEKMSKeyId)
+		return keyID == *encryption.kmsKeyID || strings.HasSuffix(keyID, "/"+*encryption.kmsKeyID)
+	}
+	return true
+}
+
+// duplicateLinks returns the links of the object a duplicate upload is answered with. Its
+// location is the download route of the service.
+func duplicateLinks(ctx context.Context, entry DedupEntry) []Link {
+	location := downloadPath + entry.Key
+	if entry.Bucket != bucket {
+		location += "?bucket=" + url.QueryEscape(entry.Bucket)
+	}
+	return []Link{
+		{
+			URL: objectURL(ctx, entry.Bucket, entry.Key, location),
+		},
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"testing"
+	"time"
+)
+
+func TestStoredAs(t *testing.T) {
+	retainUntil := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	kms := encryption{mode: encryptionKMS, serverSideEncryption: types.ServerSideEncryptionAwsKms, kmsKeyID: aws.String("1234")}
+	tests := []struct {
+		name         string
+		head         s3.HeadObjectOutput
+		encryption   encryption
+		lock         objectLock
+		storageClass types.StorageClass
+		want         bool
+	}{
+		{name: "defaults", want: true},
+		{name: "bucket default encryption", head: s3.HeadObjectOutput{ServerSideEncryption: types.ServerSideEncryptionAes256}, want: true},
+		{name: "standard storage class", head: s3.HeadObjectOutput{StorageClass: types.StorageClassStandard}, want: true},
+		{name: "other storage class", storageClass: types.StorageClassGlacierIr},
+		{name: "same storage class", head: s3.HeadObjectOutput{StorageClass: types.StorageClassGlacierIr}, storageClass: types.StorageClassGlacierIr, want: true},
+		{name: "locked object", head: s3.HeadObjectOutput{ObjectLockMode: types.ObjectLockModeGovernance, ObjectLockRetainUntilDate: &retainUntil}},
+		{
+			name: "lock retained long enough",
+			head: s3.HeadObjectOutput{ObjectLockMode: types.ObjectLockModeCompliance, ObjectLockRetainUntilDate: aws.Time(retainUntil.Add(time.Hour))},
+			lock: objectLock{mode: types.ObjectLockModeCompliance, retainUntil: &retainUntil},
+			want: true,
+		},
+		{
+			name: "lock retained too briefly",
+			head: s3.HeadObjectOutput{ObjectLockMode: types.ObjectLockModeCompliance, ObjectLockRetainUntilDate: aws.Time(retainUntil.Add(-time.Hour))},
+			lock: objectLock{mode: types.ObjectLockModeCompliance, retainUntil: &retainUntil},
+		},
+		{name: "unencrypted object", encryption: kms},
+		{
+			name:       "same KMS key",
+			head:       s3.HeadObjectOutput{ServerSideEncryption: types.ServerSideEncryptionAwsKms, SSEKMSKeyId: aws.String("arn:aws:kms:us-east-1:111122223333:key/1234")},
+			encryption: kms,
+			want:       true,
+		},
+		{
+			name:       "other KMS key",
+			head:       s3.HeadObjectOutput{ServerSideEncryption: types.ServerSideEncryptionAwsKms, SSEKMSKeyId: aws.String("arn:aws:kms:us-east-1:111122223333:key/91234")},
+			encryption: kms,
+		},
+		{name: "KMS object", head: s3.HeadObjectOutput{ServerSideEncryption: types.ServerSideEncryptionAwsKms}},
+		{
+			name:       "encryption context",
+			head:       s3.HeadObjectOutput{ServerSideEncryption: types.ServerSideEncryptionAwsKms},
+			encryption: encryption{mode: encryptionKMS, serverSideEncryption: types.ServerSideEncryptionAwsKms, kmsContext: aws.String("e30=")},
+		},
+	}
+	for _, test := range tests {
+		if got := storedAs(&test.head, test.encryption, test.lock, test.storageClass); got != test.want {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLookupDuplicate(t *testing.T) {
+	defer func(s Storage, index DedupIndex) { storage, dedupIndex = s, index }(storage, dedupIndex)
+	s := filesystemStorage{dir: t.TempDir()}
+	storage, dedupIndex = s, newMemoryDedupIndex()
+	putFilesystemObject(t, s, "a.png", "image/png", []byte("contents"))
+	ctx := context.Background()
+	if err := dedupIndex.Add(ctx, "hash", DedupEntry{Bucket: "bucket", Key: "a.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := dedupIndex.Add(ctx, "deleted", DedupEntry{Bucket: "bucket", Key: "b.png"}); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		hash, bucket string
+		want         bool
+	}{
+		{"hash", "bucket", true},
+		{"hash", "other", false},
+		{"deleted", "bucket", false},
+		{"unknown", "bucket", false},
+	}
+	for _, test := range tests {
+		entry, ok, err := lookupDuplicate(ctx, test.hash, test.bucket, encryption{}, objectLock{}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.want || (ok && entry.Key != "a.png") {
+			t.Errorf("%s in %s: got %+v, %t, want %t", test.hash, test.bucket, entry, ok, test.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"log"
+	"net/http"
+)
+
+// maxDeleteKeys is the most objects DeleteObjects deletes at once, and the most keys a batch
+// delete accepts.
+const maxDeleteKeys = 1000
+
+type DeleteRequest struct {
+	Keys []string `json:"keys"`
+}
+
+// DeleteError is a key of a batch delete that was not deleted.
+type DeleteError struct {
+	Key     string `json:"key"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type DeleteResult struct {
+	Deleted []string      `json:"deleted"`
+	Errors  []DeleteError `json:"errors"`
+}
+
+// deleteFiles serves DELETE /api/v1/file?bucket={bucket} with a JSON body {"keys": [...]},
+// deleting up to 1000 objects of BUCKET, or of the bucket query parameter, and the posters of
+// videos with DeleteMany. The keys that could not be deleted are answered in errors instead of
+// failing the whole request. As with the deletes of single objects, only keys with the format of
+// the generated ones are deleted, and API keys only delete their own objects.
+func deleteFiles(w http.ResponseWriter, r *http.Request) {
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		bucketName = bucket
+	}
+	if !knownBucket(bucketName) {
+		writeError(w, http.StatusBadRequest, "invalid_bucket", "unknown bucket")
+		return
+	}
+	var request DeleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+	if len(request.Keys) == 0 || len(request.Keys) > maxDeleteKeys {
+		writeError(w, http.StatusBadRequest, "invalid_keys", "between 1 and 1000 keys must be deleted")
+		return
+	}
+	result := DeleteResult{
+		Deleted: []string{},
+		Errors:  []DeleteError{},
+	}
+	// Posters are deleted along with their video but only the requested keys are answered.
+	var objects []types.ObjectIdentifier
+	requested := make(map[string]bool, len(request.Keys))
+	for _, key := range request.Keys {
+		switch {
+		case requested[key]:
+			continue
+		case !validKey(key):
+			result.Errors = append(result.Errors, DeleteError{Key: key, Code: "invalid_key", Message: "the key was not generated by an upload"})
+			continue
+		case !ownsKey(r, key):
+			result.Errors = append(result.Errors, DeleteError{Key: key, Code: "not_found", Message: "no such key"})
+			continue
+		}
+		requested[key] = true
+		for _, key := range withPosterKey(key) {
+			objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+		}
+	}
+	failed := make(map[string]bool)
+	ctx := r.Context()
+	for start := 0; start < len(objects); start += maxDeleteKeys {
+		end := start + maxDeleteKeys
+		if end > len(objects) {
+			end = len(objects)
+		}
+		output, err := storage.DeleteMany(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucketName),
+			Delete: &types.Delete{
+				Objects: objects[start:end],
+				Quiet:   true,
+			},
+		})
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		for _, deleteErr := range output.Errors {
+			key := aws.ToString(deleteErr.Key)
+			failed[key] = true
+			if requested[key] {
+				result.Errors = append(result.Errors, DeleteError{
+					Key:     key,
+					Code:    snakeCase(aws.ToString(deleteErr.Code)),
+					Message: aws.ToString(deleteErr.Message),
+				})
+			} else {
+				log.Printf("deleting %s: %s", key, aws.ToString(deleteErr.Message))
+			}
+		}
+	}
+	for _, object := range objects {
+		key := aws.ToString(object.Key)
+		if failed[key] {
+			continue
+		}
+		forgetObject(bucketName, key)
+		if requested[key] {
+			result.Deleted = append(result.Deleted, key)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif"  // Registers the GIF format for image.DecodeConfig.
+	_ "image/jpeg" // Registers the JPEG format for image.DecodeConfig.
+	_ "image/png"  // Registers the PNG format for image.DecodeConfig.
+	"io"
+)
+
+// maxHeaderSize bounds the bytes kept from the start of a body to read image headers from.
+// JPEG dimensions may follow large EXIF segments, which is why it is not smaller.
+const maxHeaderSize = 128 * 1024
+
+// reportDimensions makes image uploads return their width and height.
+var reportDimensions bool
+
+// headerRecorder keeps a copy of the first limit bytes read through it.
+type headerRecorder struct {
+	io.Reader
+	limit  int
+	header []byte
+}
+
+func (r *headerRecorder) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if free := r.limit - len(r.header); free > 0 {
+		if free > n {
+			free = n
+		}
+		r.header = append(r.header, p[:free]...)
+	}
+	return n, err
+}
+
+// imageDimensions returns the width and height of the image the header belongs to, reading only
+// its header, or false when they cannot be determined.
+func imageDimensions(header []byte) (int, int, bool) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(header))
+	if err != nil {
+		return 0, 0, false
+	}
+	return config.Width, config.Height, true
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// cache is nil when CACHE_DIR is not set.
+var cache *diskCache
+
+// cacheTempPrefix starts the names of the temporary files of the uploads being cached.
+const cacheTempPrefix = ".upload-"
+
+// diskCache keeps copies of uploaded objects on local disk, evicting the least recently used ones
+// once their total size exceeds maxSize. Files are named after the hash of their bucket and key,
+// and only appear under that name once the upload is completed.
+type diskCache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List // Most recently used first.
+	entries map[string]*list.Element
+}
+
+type cacheEntry struct {
+	name        string
+	size        int64
+	contentType string
+}
+
+// newDiskCache creates the cache directory, removing the cache files a previous process left in
+// it, as the index of the cache is only kept in memory. Other files of the directory are kept.
+func newDiskCache(dir string, maxSize int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() && isCacheFile(entry.Name()) {
+			if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &diskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}, nil
+}
+
+func cacheName(bucket, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return hex.EncodeToString(sum[:])
+}
+
+// isCacheFile reports whether the file name is one the cache writes: the name of an object or
+// the temporary file of an upload.
+func isCacheFile(name string) bool {
+	if strings.HasPrefix(name, cacheTempPrefix) {
+		return true
+	}
+	return len(name) == sha256.Size*2 && strings.Trim(name, "0123456789abcdef") == ""
+}
+
+// writer returns a cacheWriter to a new temporary file of the cache.
+func (c *diskCache) writer() (*cacheWriter, error) {
+	file, err := os.CreateTemp(c.dir, cacheTempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &cacheWriter{cache: c, file: file}, nil
+}
+
+// open returns the cached file of the object and its content type.
+func (c *diskCache) open(bucket, key string) (*os.File, string, bool) {
+	name := cacheName(bucket, key)
+	c.mu.Lock()
+	element, ok := c.entries[name]
+	if ok {
+		c.lru.MoveToFront(element)
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, "", false
+	}
+	// The file may have been evicted since; an open file stays readable once removed.
+	file, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		return nil, "", false
+	}
+	return file, element.Value.(*cacheEntry).contentType, true
+}
+
+func (c *diskCache) add(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.name]; ok {
+		c.size -= element.Value.(*cacheEntry).size
+		c.lru.Remove(element)
+	}
+	c.entries[entry.name] = c.lru.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		evicted := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.entries, evicted.name)
+		c.size -= evicted.size
+		os.Remove(filepath.Join(c.dir, evicted.name))
+	}
+}
+
+// remove drops the object from the cache.
+func (c *diskCache) remove(bucket, key string) {
+	name := cacheName(bucket, key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[name]
+	if !ok {
+		return
+	}
+	c.lru.Remove(element)
+	delete(c.entries, name)
+	c.size -= element.Value.(*cacheEntry).size
+	os.Remove(filepath.Join(c.dir, name))
+}
+
+// cacheWriter writes an upload to a temporary file of the cache. It never fails the upload:
+// once a write fails or the upload outgrows the cache, the rest is ignored and the file is not
+// added to the cache.
+type cacheWriter struct {
+	cache  *diskCache
+	file   *os.File
+	size   int64
+	failed bool
+	closed bool
+}
+
+func (w *cacheWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return len(p), nil
+	}
+	if w.size+int64(len(p)) > w.cache.maxSize {
+		w.failed = true
+		return len(p), nil
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		w.failed = true
+	}
+	return len(p), nil
+}
+
+// commit renames the file to the object name and adds it to the cache.
+func (w *cacheWriter) commit(bucket, key, contentType string) error {
+	if w.failed {
+		return w.discard()
+	}
+	w.closed = true
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	name := cacheName(bucket, key)
+	if err := os.Rename(w.file.Name(), filepath.Join(w.cache.dir, name)); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	w.cache.add(&cacheEntry{name: name, size: w.size, contentType: contentType})
+	return nil
+}
+
+// discard removes the file, unless it was committed.
+func (w *cacheWriter) discard() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return closeTemp(w.file)
+}
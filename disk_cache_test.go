@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDiskCacheKeepsOtherFiles(t *testing.T) {
+	dir := t.TempDir()
+	stale := []string{cacheName("bucket", "a.png"), cacheTempPrefix + "123"}
+	kept := []string{"notes.txt", "0123"}
+	for _, name := range append(stale, kept...) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, cacheName("bucket", "b.png")), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newDiskCache(dir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range stale {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s: got %v, want it removed", name, err)
+		}
+	}
+	for _, name := range append(kept, cacheName("bucket", "b.png")) {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s: got %v, want it kept", name, err)
+		}
+	}
+}
+
+func TestDiskCacheCommit(t *testing.T) {
+	c, err := newDiskCache(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := c.writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("contents")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.commit("bucket", "a.png", "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	file, contentType, ok := c.open("bucket", "a.png")
+	if !ok {
+		t.Fatal("the committed object is not cached")
+	}
+	file.Close()
+	if contentType != "image/png" {
+		t.Errorf("got content type %q, want image/png", contentType)
+	}
+	c.remove("bucket", "a.png")
+	if _, _, ok := c.open("bucket", "a.png"); ok {
+		t.Error("the removed object is still cached")
+	}
+}
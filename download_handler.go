@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const downloadPath = "/api/v1/file/"
+
+// downloadHandler serves GET /api/v1/file/{key}?bucket={bucket} with the object, from the disk
+// cache when it holds it and streamed from Amazon S3 otherwise. The bucket defaults to BUCKET.
+// A Range header answers 206 with the requested bytes. HEAD answers the headers of the object
+// alone, DELETE deletes it, and POST /api/v1/file/{key}/copy copies it.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, copySuffix):
+		copyFile(w, r)
+		return
+	case r.Method == http.MethodHead:
+		headFile(w, r)
+		return
+	case r.Method == http.MethodDelete:
+		deleteFile(w, r, strings.TrimPrefix(r.URL.Path, downloadPath))
+		return
+	case r.Method != http.MethodGet:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, downloadPath)
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		bucketName = bucket
+	}
+	if key == "" || !knownBucket(bucketName) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "missing key or unknown bucket")
+		return
+	}
+	if !servedKey(key) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "the key was not generated by an upload")
+		return
+	}
+	if !ownsKey(r, key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	}
+	if cache != nil {
+		if file, contentType, ok := cache.open(bucketName, key); ok {
+			defer file.Close()
+			w.Header().Set("Content-Type", contentType)
+			// The cache does not know the ETag and modification time of the object.
+			http.ServeContent(w, r, "", time.Time{}, file)
+			return
+		}
+	}
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	}
+	if byteRange := r.Header.Get("Range"); byteRange != "" {
+		input.Range = aws.String(byteRange)
+	}
+	output, err := getObjectConsistent(r.Context(), input)
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	defer output.Body.Close()
+	if output.ContentType != nil {
+		w.Header().Set("Content-Type", *output.ContentType)
+	}
+	if output.ETag != nil {
+		w.Header().Set("ETag", *output.ETag)
+	}
+	if output.LastModified != nil {
+		w.Header().Set("Last-Modified", output.LastModified.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(output.ContentLength, 10))
+	statusCode := http.StatusOK
+	if output.ContentRange != nil {
+		w.Header().Set("Content-Range", *output.ContentRange)
+		statusCode = http.StatusPartialContent
+	}
+	w.WriteHeader(statusCode)
+	if _, err := io.Copy(w, output.Body); err != nil {
+		log.Print(err)
+	}
+}
+
+// headFile serves HEAD /api/v1/file/{key}?bucket={bucket} with the Content-Type,
+// Content-Length, ETag and Last-Modified of the object, its storage class and version ID, and
+// its user-defined metadata, such as the content hashes of STORE_CONTENT_HASH, in X-Amz-Meta-*
+// headers. Objects encrypted with a customer key need the key in X-Encryption-Key.
+func headFile(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, downloadPath)
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		bucketName = bucket
+	}
+	if key == "" || !knownBucket(bucketName) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "missing key or unknown bucket")
+		return
+	}
+	if !servedKey(key) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "the key was not generated by an upload")
+		return
+	}
+	if !ownsKey(r, key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	}
+	var encryption encryption
+	if customerKey := r.Header.Get("X-Encryption-Key"); customerKey != "" {
+		var err error
+		encryption, err = parseEncryption(encryptionCustomer, customerKey, "", []string{encryptionCustomer})
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_encryption", err.Error())
+			return
+		}
+	}
+	output, err := storage.Head(r.Context(), &s3.HeadObjectInput{
+		Bucket:               aws.String(bucketName),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if output.ContentType != nil {
+		w.Header().Set("Content-Type", *output.ContentType)
+	}
+	if output.ETag != nil {
+		w.Header().Set("ETag", *output.ETag)
+	}
+	if output.LastModified != nil {
+		w.Header().Set("Last-Modified", output.LastModified.UTC().Format(http.TimeFormat))
+	}
+	if output.StorageClass != "" {
+		w.Header().Set("X-Amz-Storage-Class", string(output.StorageClass))
+	}
+	if output.VersionId != nil {
+		w.Header().Set("X-Amz-Version-Id", *output.VersionId)
+	}
+	for name, value := range output.Metadata {
+		w.Header().Set(metadataHeaderPrefix+name, value)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(output.ContentLength, 10))
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"time"
+)
+
+// emfNamespace is the CloudWatch namespace of the Embedded Metric Format records.
+var emfNamespace = "MultipartUpload"
+
+type emfMetric struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+type emfDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetadata struct {
+	Timestamp         int64          `json:"Timestamp"`
+	CloudWatchMetrics []emfDirective `json:"CloudWatchMetrics"`
+}
+
+type emfRecord struct {
+	AWS            emfMetadata `json:"_aws"`
+	ContentType    string      `json:"ContentType"`
+	Result         string      `json:"Result"`
+	Uploads        int         `json:"Uploads"`
+	UploadErrors   int         `json:"UploadErrors"`
+	UploadBytes    int64       `json:"UploadBytes"`
+	UploadDuration float64     `json:"UploadDuration"`
+}
+
+var emfEncoder = json.NewEncoder(os.Stdout)
+
+// emitEMF writes an Embedded Metric Format record to stdout, from which CloudWatch Logs
+// extracts the upload metrics.
+func emitEMF(contentType string, statusCode int, bytes int64, duration time.Duration) {
+	record := emfRecord{
+		AWS: emfMetadata{
+			Timestamp: time.Now().UnixMilli(),
+			CloudWatchMetrics: []emfDirective{
+				{
+					Namespace:  emfNamespace,
+					Dimensions: [][]string{{"ContentType", "Result"}},
+					Metrics: []emfMetric{
+						{Name: "Uploads", Unit: "Count"},
+						{Name: "UploadErrors", Unit: "Count"},
+						{Name: "UploadBytes", Unit: "Bytes"},
+						{Name: "UploadDuration", Unit: "Milliseconds"},
+					},
+				},
+			},
+		},
+		ContentType:    contentType,
+		Result:         "success",
+		Uploads:        1,
+		UploadBytes:    bytes,
+		UploadDuration: float64(duration) / float64(time.Millisecond),
+	}
+	if statusCode >= http.StatusBadRequest {
+		record.Result = "error"
+		record.UploadErrors = 1
+	}
+	if err := emfEncoder.Encode(record); err != nil {
+		log.Print(err)
+	}
+}
+
+// emfMiddleware emits an Embedded Metric Format record for every upload served by next.
+func emfMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		start := time.Now()
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next(recorder, r)
+		contentType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil {
+			contentType = "unknown"
+		}
+		emitEMF(contentType, recorder.statusCode, body.n, time.Since(start))
+	}
+}
+
+// countingReader counts the bytes read from the request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// statusRecorder records the status code and the size of the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	bytes       int64
+}
+
+func (w *statusRecorder) WriteHeader(statusCode int) {
+	if !w.wroteHeader {
+		w.statusCode = statusCode
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush flushes the response, when it supports it, so that events are streamed.
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"net/http"
+	"strings"
+)
+
+// Encryption modes selectable through the X-Encryption header.
+const (
+	encryptionNone     = "none"     // No server-side encryption.
+	encryptionS3       = "s3"       // SSE-S3, "s3".
+	encryptionKMS      = "kms"      // SSE-KMS, "kms" or "kms:<key id>".
+	encryptionCustomer = "customer" // SSE-C, the key is sent base64 encoded in X-Encryption-Key.
+)
+
+var (
+	errEncryptionNotAllowed  = errors.New("encryption mode not allowed")
+	errEncryptionKeyMismatch = errors.New("X-Encryption-Key does not match the key the upload was started with")
+)
+
+// defaultEncryption applies to the uploads that do not select one with X-Encryption. It
+// defaults to no encryption, leaving it to the bucket.
+var defaultEncryption encryption
+
+// encryption holds the server-side encryption fields shared by every request of an upload.
+// Amazon S3 requires the SSE-C fields to be repeated on each of them.
+type encryption struct {
+	mode                 string
+	serverSideEncryption types.ServerSideEncryption
+	kmsKeyID             *string
+	kmsContext           *string // Base64 encoded JSON, as Amazon S3 expects it.
+	customerAlgorithm    *string
+	customerKey          *string
+	customerKeyMD5       *string
+}
+
+// parseEncryption returns the encryption selected by the X-Encryption header value, which
+// defaults to defaultEncryption, and checks that its mode is one of the allowed modes. The
+// kmsContext JSON object, from X-Encryption-Context, replaces the encryption context of SSE-KMS
+// and is rejected with the other modes.
+func parseEncryption(header, customerKey, kmsContext string, allowed []string) (encryption, error) {
+	mode, kmsKeyID, _ := strings.Cut(strings.TrimSpace(header), ":")
+	if mode == "" {
+		e := defaultEncryption
+		if kmsContext == "" {
+			return e, nil
+		}
+		if e.mode != encryptionKMS {
+			return encryption{}, errors.New("X-Encryption-Context requires SSE-KMS")
+		}
+		var err error
+		e.kmsContext, err = encodeEncryptionContext(kmsContext)
+		return e, err
+	}
+	var e encryption
+	switch mode {
+	case encryptionNone:
+	case encryptionS3:
+		e.serverSideEncryption = types.ServerSideEncryptionAes256
+	case encryptionKMS:
+		e.serverSideEncryption = types.ServerSideEncryptionAwsKms
+		if kmsKeyID != "" {
+			e.kmsKeyID = aws.String(kmsKeyID)
+		}
+		if kmsContext != "" {
+			var err error
+			e.kmsContext, err = encodeEncryptionContext(kmsContext)
+			if err != nil {
+				return encryption{}, err
+			}
+		}
+	case encryptionCustomer:
+		key, err := base64.StdEncoding.DecodeString(customerKey)
+		if err != nil || len(key) != 32 {
+			return encryption{}, errors.New("X-Encryption-Key must be a base64 encoded 256-bit key")
+		}
+		sum := md5.Sum(key)
+		e.customerAlgorithm = aws.String(string(types.ServerSideEncryptionAes256))
+		e.customerKey = aws.String(customerKey)
+		e.customerKeyMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+	default:
+		return encryption{}, fmt.Errorf("unknown encryption mode %q", mode)
+	}
+	if kmsContext != "" && mode != encryptionKMS {
+		return encryption{}, errors.New("X-Encryption-Context requires SSE-KMS")
+	}
+	e.mode = mode
+	for _, m := range allowed {
+		if m == mode {
+			return e, nil
+		}
+	}
+	return encryption{}, errEncryptionNotAllowed
+}
+
+// requestEncryption returns the encryption selected by the X-Encryption, X-Encryption-Key and
+// X-Encryption-Context headers of the request.
+func requestEncryption(r *http.Request) (encryption, error) {
+	return parseEncryption(r.Header.Get("X-Encryption"), r.Header.Get("X-Encryption-Key"), r.Header.Get("X-Encryption-Context"), allowedEncryption)
+}
+
+// sessionEncryption returns the encryption the session was started with. An SSE-C key is never
+// stored with the session: every request of the upload sends it again in X-Encryption-Key, and
+// it must be the key the upload was started with.
+func sessionEncryption(r *http.Request, session session) (encryption, error) {
+	e, err := parseEncryption(session.Encryption, r.Header.Get("X-Encryption-Key"), session.EncryptionContext, allowedEncryption)
+	if err != nil {
+		return encryption{}, err
+	}
+	if aws.ToString(e.customerKeyMD5) != session.CustomerKeyMD5 {
+		return encryption{}, errEncryptionKeyMismatch
+	}
+	return e, nil
+}
+
+// writeEncryptionError answers an upload whose encryption headers were rejected.
+func writeEncryptionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errEncryptionNotAllowed) {
+		writeError(w, http.StatusForbidden, "encryption_not_allowed", err.Error())
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid_encryption", err.Error())
+}
+
+// encryptionStrength orders the modes by the protection they give at rest.
+var encryptionStrength = map[string]int{
+	encryptionNone:     0,
+	encryptionS3:       1,
+	encryptionKMS:      2,
+	encryptionCustomer: 2,
+}
+
+// withoutWeakerEncryption returns the allowed modes but the ones weaker than mode, so that
+// clients cannot opt out of the SSE_MODE encryption with X-Encryption.
+func withoutWeakerEncryption(allowed []string, mode string) []string {
+	var stronger []string
+	for _, m := range allowed {
+		if encryptionStrength[m] >= encryptionStrength[mode] {
+			stronger = append(stronger, m)
+		}
+	}
+	return stronger
+}
+
+// parseSSEMode returns the encryption of an SSE_MODE, "AES256" or "aws:kms", which requires
+// the KMS key ID and accepts an encryption context.
+func parseSSEMode(mode, kmsKeyID, kmsContext string) (encryption, error) {
+	if kmsContext != "" && types.ServerSideEncryption(mode) != types.ServerSideEncryptionAwsKms {
+		return encryption{}, errors.New("SSE_KMS_ENCRYPTION_CONTEXT requires SSE_MODE aws:kms")
+	}
+	switch types.ServerSideEncryption(mode) {
+	case types.ServerSideEncryptionAes256:
+		return encryption{mode: encryptionS3, serverSideEncryption: types.ServerSideEncryptionAes256}, nil
+	case types.ServerSideEncryptionAwsKms:
+		if kmsKeyID == "" {
+			return encryption{}, errors.New("SSE_MODE aws:kms requires SSE_KMS_KEY_ID")
+		}
+		e := encryption{mode: encryptionKMS, serverSideEncryption: types.ServerSideEncryptionAwsKms, kmsKeyID: aws.String(kmsKeyID)}
+		if kmsContext != "" {
+			var err error
+			e.kmsContext, err = encodeEncryptionContext(kmsContext)
+			if err != nil {
+				return encryption{}, fmt.Errorf("invalid SSE_KMS_ENCRYPTION_CONTEXT: %v", err)
+			}
+		}
+		return e, nil
+	default:
+		return encryption{}, fmt.Errorf("invalid SSE_MODE %q", mode)
+	}
+}
+
+// encodeEncryptionContext returns the base64 encoding Amazon S3 expects of an SSE-KMS
+// encryption context, a JSON object of strings.
+func encodeEncryptionContext(context string) (*string, error) {
+	var pairs map[string]string
+	if err := json.Unmarshal([]byte(context), &pairs); err != nil || len(pairs) == 0 {
+		return nil, errors.New("the encryption context must be a JSON object of strings")
+	}
+	encoded, err := json.Marshal(pairs)
+	if err != nil {
+		return nil, err
+	}
+	return aws.String(base64.StdEncoding.EncodeToString(encoded)), nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"strings"
+	"testing"
+)
+
+// testCustomerKey is a base64 encoded 256-bit key.
+const testCustomerKey = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+
+func TestParseEncryption(t *testing.T) {
+	all := []string{encryptionNone, encryptionS3, encryptionKMS, encryptionCustomer}
+	tests := []struct {
+		name        string
+		header      string
+		customerKey string
+		kmsContext  string
+		allowed     []string
+		wantMode    string
+		wantSSE     types.ServerSideEncryption
+		wantKMSKey  string
+		wantErr     bool
+	}{
+		{name: "default", allowed: all},
+		{name: "none", header: "none", allowed: all, wantMode: encryptionNone},
+		{name: "s3", header: "s3", allowed: all, wantMode: encryptionS3, wantSSE: types.ServerSideEncryptionAes256},
+		{name: "kms", header: "kms", allowed: all, wantMode: encryptionKMS, wantSSE: types.ServerSideEncryptionAwsKms},
+		{name: "kms key", header: "kms:alias/uploads", allowed: all, wantMode: encryptionKMS, wantSSE: types.ServerSideEncryptionAwsKms, wantKMSKey: "alias/uploads"},
+		{name: "kms context", header: "kms", kmsContext: `{"service": "uploads"}`, allowed: all, wantMode: encryptionKMS, wantSSE: types.ServerSideEncryptionAwsKms},
+		{name: "customer", header: "customer", customerKey: testCustomerKey, allowed: all, wantMode: encryptionCustomer},
+		{name: "surrounding spaces", header: " s3 ", allowed: all, wantMode: encryptionS3, wantSSE: types.ServerSideEncryptionAes256},
+		{name: "customer without key", header: "customer", allowed: all, wantErr: true},
+		{name: "customer short key", header: "customer", customerKey: "c2hvcnQ=", allowed: all, wantErr: true},
+		{name: "context without kms", header: "s3", kmsContext: `{"service": "uploads"}`, allowed: all, wantErr: true},
+		{name: "invalid context", header: "kms", kmsContext: `["uploads"]`, allowed: all, wantErr: true},
+		{name: "unknown mode", header: "rot13", allowed: all, wantErr: true},
+		{name: "not allowed", header: "none", allowed: []string{encryptionS3}, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parseEncryption(test.header, test.customerKey, test.kmsContext, test.allowed)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", e)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.mode != test.wantMode || e.serverSideEncryption != test.wantSSE || aws.ToString(e.kmsKeyID) != test.wantKMSKey {
+				t.Errorf("got mode %q, SSE %q and KMS key %q, want %q, %q and %q", e.mode, e.serverSideEncryption, aws.ToString(e.kmsKeyID), test.wantMode, test.wantSSE, test.wantKMSKey)
+			}
+			if (test.kmsContext != "") != (e.kmsContext != nil) {
+				t.Errorf("got KMS context %v for %q", e.kmsContext, test.kmsContext)
+			}
+			if test.wantMode == encryptionCustomer && (aws.ToString(e.customerKey) != test.customerKey || e.customerKeyMD5 == nil) {
+				t.Errorf("got customer key %q and MD5 %v", aws.ToString(e.customerKey), e.customerKeyMD5)
+			}
+		})
+	}
+}
+
+func TestParseEncryptionNotAllowed(t *testing.T) {
+	if _, err := parseEncryption("kms", "", "", []string{encryptionS3}); !errors.Is(err, errEncryptionNotAllowed) {
+		t.Errorf("got %v, want errEncryptionNotAllowed", err)
+	}
+}
+
+func TestWithoutWeakerEncryption(t *testing.T) {
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{mode: "", want: []string{encryptionNone, encryptionS3, encryptionKMS, encryptionCustomer}},
+		{mode: encryptionS3, want: []string{encryptionS3, encryptionKMS, encryptionCustomer}},
+		{mode: encryptionKMS, want: []string{encryptionKMS, encryptionCustomer}},
+	}
+	for _, test := range tests {
+		got := withoutWeakerEncryption([]string{encryptionNone, encryptionS3, encryptionKMS, encryptionCustomer}, test.mode)
+		if !equalStrings(got, test.want) {
+			t.Errorf("mode %q: got %q, want %q", test.mode, got, test.want)
+		}
+	}
+}
+
+func TestUploadPartEncryption(t *testing.T) {
+	defer func(s Storage) { storage = s }(storage)
+	all := []string{encryptionNone, encryptionS3, encryptionKMS, encryptionCustomer}
+	for _, header := range []string{"s3", "kms:alias/uploads", "customer"} {
+		e, err := parseEncryption(header, testCustomerKey, "", all)
+		if err != nil {
+			t.Fatal(err)
+		}
+		create := newCreateMultipartUploadInput("bucket", "key", "image/png", withEncryption(e))
+		s := &recordingStorage{}
+		storage = s
+		if _, err := uploadPart(context.Background(), testUpload, Part{Number: 1, Body: strings.NewReader("part"), Size: 4}, e); err != nil {
+			t.Fatal(err)
+		}
+		// Amazon S3 applies the SSE-S3 and SSE-KMS settings of the upload to its parts, but
+		// requires the customer key of every part.
+		part := s.inputs[0]
+		if aws.ToString(part.SSECustomerAlgorithm) != aws.ToString(create.SSECustomerAlgorithm) ||
+			aws.ToString(part.SSECustomerKey) != aws.ToString(create.SSECustomerKey) ||
+			aws.ToString(part.SSECustomerKeyMD5) != aws.ToString(create.SSECustomerKeyMD5) {
+			t.Errorf("%s: the part has algorithm %q and key MD5 %q, the upload %q and %q", header,
+				aws.ToString(part.SSECustomerAlgorithm), aws.ToString(part.SSECustomerKeyMD5),
+				aws.ToString(create.SSECustomerAlgorithm), aws.ToString(create.SSECustomerKeyMD5))
+		}
+		if header == "customer" && part.SSECustomerKey == nil {
+			t.Errorf("%s: the part has no customer key", header)
+		}
+		if create.ServerSideEncryption != e.serverSideEncryption || aws.ToString(create.SSEKMSKeyId) != aws.ToString(e.kmsKeyID) {
+			t.Errorf("%s: the upload has SSE %q and KMS key %q", header, create.ServerSideEncryption, aws.ToString(create.SSEKMSKeyId))
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/smithy-go"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ErrorResponse is the body of the error responses. Code is a stable snake_case string clients
+// can switch on.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// s3ErrorStatusCodes maps the error codes of Amazon S3 to the status the server answers with.
+// Other errors of Amazon S3 answer 503 when it failed with a 5xx status, and every other error
+// answers 500.
+var s3ErrorStatusCodes = map[string]int{
+	"AccessDenied":          http.StatusForbidden,
+	"AllAccessDisabled":     http.StatusForbidden,
+	"InvalidAccessKeyId":    http.StatusForbidden,
+	"SignatureDoesNotMatch": http.StatusForbidden,
+	"NoSuchBucket":          http.StatusNotFound,
+	"NoSuchKey":             http.StatusNotFound,
+	"NoSuchUpload":          http.StatusNotFound,
+	"NotFound":              http.StatusNotFound,
+	"RequestTimeout":        http.StatusRequestTimeout,
+	"InvalidRange":          http.StatusRequestedRangeNotSatisfiable,
+	"BadDigest":             http.StatusBadGateway,
+	"SlowDown":              http.StatusTooManyRequests,
+	"Throttling":            http.StatusTooManyRequests,
+	"ThrottlingException":   http.StatusTooManyRequests,
+	"RequestLimitExceeded":  http.StatusTooManyRequests,
+	"InternalError":         http.StatusServiceUnavailable,
+	"ServiceUnavailable":    http.StatusServiceUnavailable,
+}
+
+// parseErrorStatusCodes parses comma separated "ErrorCode=status" pairs.
+func parseErrorStatusCodes(s string) (map[string]int, error) {
+	codes := make(map[string]int)
+	for _, pair := range strings.Split(s, ",") {
+		code, status, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		n, err := strconv.Atoi(status)
+		if !ok || code == "" || err != nil || n < 400 || n > 599 {
+			return nil, fmt.Errorf("invalid error status code %q", pair)
+		}
+		codes[code] = n
+	}
+	return codes, nil
+}
+
+// writeError writes the error response.
+func writeError(w http.ResponseWriter, statusCode int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(ErrorResponse{
+		Code:    code,
+		Message: message,
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// writeS3Error logs the error with the ID of the request and answers with the status its Amazon
+// S3 error code maps to. Errors that do not come from Amazon S3 answer 500 without revealing
+// their details.
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	logEntry(r.Context(), logLevelError, "request failed", "error", err)
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		writeError(w, http.StatusInternalServerError, "internal_error", "internal error")
+		return
+	}
+	statusCode, ok := s3ErrorStatusCodes[apiErr.ErrorCode()]
+	if !ok {
+		statusCode = http.StatusInternalServerError
+		var responseError *awshttp.ResponseError
+		if errors.As(err, &responseError) && responseError.HTTPStatusCode() >= http.StatusInternalServerError {
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+	writeError(w, statusCode, snakeCase(apiErr.ErrorCode()), apiErr.ErrorMessage())
+}
+
+// snakeCase converts an error code such as "NoSuchBucket" to "no_such_bucket".
+func snakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/smithy-go"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// checkErrorResponse fails unless w answered the status with a JSON error of the code.
+func checkErrorResponse(t *testing.T, w *httptest.ResponseRecorder, statusCode int, code string) {
+	t.Helper()
+	if w.Code != statusCode {
+		t.Errorf("got status %d, want %d", w.Code, statusCode)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got Content-Type %q, want application/json", contentType)
+	}
+	var response ErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != code || response.Message == "" {
+		t.Errorf("got %+v, want code %q with a message", response, code)
+	}
+}
+
+func TestHandlerErrorResponses(t *testing.T) {
+	defer func(size int64) { maxContentSize = size }(maxContentSize)
+	maxContentSize = minUploadPartSize
+
+	w := httptest.NewRecorder()
+	fileHandler(w, httptest.NewRequest(http.MethodPatch, "/api/v1/file", nil))
+	checkErrorResponse(t, w, http.StatusMethodNotAllowed, "method_not_allowed")
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/file", strings.NewReader("text"))
+	r.Header.Set("Content-Type", "text/plain")
+	fileHandler(w, r)
+	checkErrorResponse(t, w, http.StatusUnsupportedMediaType, "unsupported_media_type")
+
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest(http.MethodPost, "/api/v1/file", strings.NewReader(pngHeader))
+	r.Header.Set("Content-Type", "image/png")
+	r.ContentLength = maxContentSize + 1
+	fileHandler(w, r)
+	checkErrorResponse(t, w, http.StatusRequestEntityTooLarge, "entity_too_large")
+}
+
+func TestWriteS3Error(t *testing.T) {
+	tests := []struct {
+		err        error
+		statusCode int
+		code       string
+	}{
+		{err: fmt.Errorf("getting: %w", &smithy.GenericAPIError{Code: "NoSuchKey", Message: "no such key"}), statusCode: http.StatusNotFound, code: "no_such_key"},
+		{err: &smithy.GenericAPIError{Code: "SlowDown", Message: "slow down"}, statusCode: http.StatusTooManyRequests, code: "slow_down"},
+		{err: &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "precondition failed"}, statusCode: http.StatusInternalServerError, code: "precondition_failed"},
+		{err: errors.New("open /tmp/part: no space left on device"), statusCode: http.StatusInternalServerError, code: "internal_error"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		writeS3Error(w, httptest.NewRequest(http.MethodGet, "/", nil), test.err)
+		if strings.Contains(w.Body.String(), "no space left") {
+			t.Errorf("the response reveals the error: %s", w.Body)
+		}
+		checkErrorResponse(t, w, test.statusCode, test.code)
+	}
+}
@@ -2,156 +2,683 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/google/uuid"
 	"io"
-	"log"
+	"mime"
 	"net/http"
+	"path"
 	"strings"
+	"time"
 )
 
+// The smallest part Amazon S3 accepts, but for the last one, and the largest.
 const (
-	maxContentSize    int64 = 1024 * 1024 * 1000 // 100 MB
-	minUploadPartSize int64 = 1024 * 1024 * 5    // 5 MB
+	minUploadPartSize int64 = 1024 * 1024 * 5        // 5 MB
+	maxUploadPartSize int64 = 1024 * 1024 * 1024 * 5 // 5 GB
 )
 
+// Set from the service configuration.
+var (
+	maxContentSize int64
+	partSize       int64 // Size of the parts the server splits bodies into.
+)
+
+// contentTypes lists the accepted content type prefixes of each upload route.
+var contentTypes = map[string][]string{
+	"/api/v1/file":   {"image/", "video/"},
+	"/api/v1/images": {"image/"},
+	"/api/v1/videos": {"video/"},
+}
+
 type Link struct {
+	Rel string `json:"rel,omitempty"`
 	URL string `json:"url"`
 }
 
 type Message struct {
-	Key   string `json:"key"`
-	Links []Link `json:"links"`
+	Bucket         string            `json:"bucket"`
+	Key            string            `json:"key"`
+	Links          []Link            `json:"links"`
+	LifecycleHints map[string]string `json:"lifecycleHints,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Deduplicated   bool              `json:"deduplicated,omitempty"`
+	Width          int               `json:"width,omitempty"`
+	Height         int               `json:"height,omitempty"`
+	Size           int64             `json:"size,omitempty"`
+	SHA256         string            `json:"sha256,omitempty"`
+	MD5            string            `json:"md5,omitempty"`
+	VersionID      string            `json:"versionId,omitempty"`
+	StagingKey     string            `json:"stagingKey,omitempty"`
+	ConfirmToken   string            `json:"confirmToken,omitempty"`
 }
 
 func fileHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
-		contentType := r.Header.Get("Content-Type")
-		if strings.HasPrefix(contentType, "video/") {
-			w.WriteHeader(http.StatusUnsupportedMediaType)
-			return
-		}
-		if r.ContentLength > maxContentSize {
-			w.WriteHeader(http.StatusRequestEntityTooLarge)
-			return
-		}
-		ctx := r.Context()
-		multipartUploadOutput, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
-			Bucket:                    aws.String(bucket),
-			Key:                       aws.String(uuid.New().String()),
-			ACL:                       types.ObjectCannedACLPrivate,
-			BucketKeyEnabled:          false,
-			CacheControl:              nil,
-			ContentDisposition:        nil,
-			ContentEncoding:           nil,
-			ContentLanguage:           nil,
-			ContentType:               aws.String(contentType),
-			ExpectedBucketOwner:       nil,
-			Expires:                   nil,
-			GrantFullControl:          nil,
-			GrantRead:                 nil,
-			GrantReadACP:              nil,
-			GrantWriteACP:             nil,
-			Metadata:                  nil,
-			ObjectLockLegalHoldStatus: "",
-			ObjectLockMode:            "",
-			ObjectLockRetainUntilDate: nil,
-			RequestPayer:              "",
-			SSECustomerAlgorithm:      nil,
-			SSECustomerKey:            nil,
-			SSECustomerKeyMD5:         nil,
-			SSEKMSEncryptionContext:   nil,
-			SSEKMSKeyId:               nil,
-			ServerSideEncryption:      "",
-			StorageClass:              "",
-			Tagging:                   nil,
-			WebsiteRedirectLocation:   nil,
-		})
-		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		var buffer bytes.Buffer
-		var completedParts []types.CompletedPart
-		var lastPart bool
-		var partNumber int32 = 1 // The first part number must always start with 1.
-		for !lastPart {
-			n, err := io.CopyN(&buffer, r.Body, minUploadPartSize)
-			// The io.EOF error occurs when the stream has reached its end.
-			if n == 0 || err == io.EOF {
-				lastPart = true
-			} else if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+		if normalizeContentType(r.Header.Get("Content-Type")) == "multipart/form-data" {
+			uploadForm(w, r)
+			return
+		}
+		uploadFile(w, r, nil)
+	case http.MethodGet:
+		presignDownload(w, r)
+		return
+	case http.MethodDelete:
+		if key := r.URL.Query().Get("key"); key != "" {
+			deleteFile(w, r, key)
+			return
+		}
+		deleteFiles(w, r)
+		return
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+}
+
+var errContentTooLarge = errors.New("content too large")
+
+// sizeLimitReader fails reads once more than limit bytes were read, so that bodies of unknown
+// length, such as chunked ones and the files of forms, are bounded as those with a
+// Content-Length.
+type sizeLimitReader struct {
+	reader    io.Reader
+	remaining int64
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.remaining+1 {
+		p = p[:r.remaining+1]
+	}
+	n, err := r.reader.Read(p)
+	if int64(n) > r.remaining {
+		n = int(r.remaining)
+		r.remaining = 0
+		return n, errContentTooLarge
+	}
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// writeContentTooLarge answers an upload whose body exceeds the maximum content size.
+func writeContentTooLarge(w http.ResponseWriter) {
+	writeError(w, http.StatusRequestEntityTooLarge, "entity_too_large", "content too large")
+}
+
+// uploadFile stores the request body as a new object. companionPoster, when not nil, is stored
+// as the poster of the video instead of extracting one.
+func uploadFile(w http.ResponseWriter, r *http.Request, companionPoster []byte) {
+	contentType := normalizeContentType(r.Header.Get("Content-Type"))
+	if !acceptedContentType(contentType, contentTypes[r.URL.Path]) {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "unsupported content type")
+		return
+	}
+	if r.ContentLength > maxContentSize {
+		writeContentTooLarge(w)
+		return
+	}
+	if writeShed(w) {
+		return
+	}
+	// The SHA-256 declared by the client identifies the upload before its body is read.
+	// Transcoding changes the contents, so it cannot be combined with it.
+	declaredSum := strings.ToLower(r.Header.Get("X-Content-SHA256"))
+	if declaredSum != "" {
+		if _, err := hex.DecodeString(declaredSum); err != nil || len(declaredSum) != 2*sha256.Size || (enableTranscode && r.Header.Get("X-Target-Format") != "") {
+			writeError(w, http.StatusBadRequest, "invalid_content_sha256", "invalid X-Content-SHA256")
+			return
+		}
+	}
+	// The base64 encoded SHA-256 of the whole contents, as Amazon S3 checksums are encoded.
+	declaredChecksum := r.Header.Get("X-Amz-Checksum-Sha256")
+	if declaredChecksum != "" {
+		if sum, err := base64.StdEncoding.DecodeString(declaredChecksum); err != nil || len(sum) != sha256.Size || (enableTranscode && r.Header.Get("X-Target-Format") != "") {
+			writeError(w, http.StatusBadRequest, "invalid_checksum_sha256", "invalid X-Amz-Checksum-Sha256")
+			return
+		}
+	}
+	// The progress of uploads sent with an X-Upload-Id is served until shortly after they finish.
+	var progress *uploadProgress
+	if id := r.Header.Get("X-Upload-Id"); id != "" {
+		if _, err := uuid.Parse(id); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_upload_id", "X-Upload-Id must be a UUID")
+			return
+		}
+		var ok bool
+		progress, ok = uploadProgresses.start(keyPrefix(r)+id, r.ContentLength)
+		if !ok {
+			writeError(w, http.StatusConflict, "upload_id_in_use", "an upload with the same X-Upload-Id is tracked")
+			return
+		}
+		defer uploadProgresses.finish(progress)
+		w.Header().Set("X-Upload-Id", id)
+	}
+	deadline := withDeadline(throttle(r.Context(), &sizeLimitReader{reader: r.Body, remaining: maxContentSize}))
+	// The body must look like the declared type, so that it cannot be stored under its extension
+	// otherwise. The sniffed bytes are still part of the first part.
+	sniffed, requestBody, err := sniffBody(deadline)
+	if errors.Is(err, errUploadDuration) {
+		logEntry(r.Context(), logLevelInfo, "upload cut off", "error", err, "bytes", deadline.n)
+		writeUploadDuration(w)
+		return
+	} else if errors.Is(err, errContentTooLarge) {
+		writeContentTooLarge(w)
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if !matchesSniffed(contentType, sniffed, contentTypes[r.URL.Path]) {
+		logEntry(r.Context(), logLevelInfo, "content type mismatch", "declared", contentType, "sniffed", sniffed)
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "contents do not match the content type")
+		return
+	}
+	if target := r.Header.Get("X-Target-Format"); enableTranscode && target != "" {
+		transcoded, transcodedType, err := transcode(requestBody, target)
+		if errors.Is(err, errUploadDuration) {
+			logEntry(r.Context(), logLevelInfo, "upload cut off", "error", err, "bytes", deadline.n)
+			writeUploadDuration(w)
+			return
+		} else if errors.Is(err, errContentTooLarge) {
+			writeContentTooLarge(w)
+			return
+		} else if errors.Is(err, errTranscodeTooLarge) || errors.Is(err, errUnsupportedFormat) {
+			logEntry(r.Context(), logLevelError, "transcoding failed", "error", err)
+			writeError(w, http.StatusUnprocessableEntity, "transcode_failed", err.Error())
+			return
+		} else if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		requestBody = bytes.NewReader(transcoded)
+		contentType = transcodedType
+	}
+	encryption, err := requestEncryption(r)
+	if err != nil {
+		writeEncryptionError(w, err)
+		return
+	}
+	callback, err := callbackURL(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_callback_url", err.Error())
+		return
+	}
+	lock, hints, tags, ok := requestRetention(w, r)
+	if !ok {
+		return
+	}
+	storageClass, err := requestStorageClass(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_storage_class", err.Error())
+		return
+	}
+	metadata, err := requestMetadata(r.Header)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	if companionPoster == nil && rejectsVideo(contentType, encryption) {
+		writeError(w, http.StatusUnprocessableEntity, "poster_unavailable", "a poster cannot be extracted from the video")
+		return
+	}
+	// The hashes are only added once the body is read, but must fit in the metadata.
+	if storeContentHash {
+		if err := checkMetadataSize(withContentHash(metadata, strings.Repeat("0", 24), strings.Repeat("0", 64))); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+			return
+		}
+	}
+	ctx := r.Context()
+	// Uploads encrypted with a customer key are not deduplicated, as other clients could not
+	// read their contents, and neither are those of API keys, whose objects are their own.
+	deduplicate := dedupIndex != nil && encryption.customerKey == nil && keyPrefix(r) == ""
+	if keyReservation != nil && declaredSum != "" {
+		reservedSum := keyPrefix(r) + declaredSum
+		if err := reserveKey(ctx, reservedSum); errors.Is(err, errKeyReserved) {
+			writeError(w, http.StatusConflict, "upload_in_progress", "an upload with the same contents is in progress")
+			return
+		} else if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		defer func() {
+			if err := keyReservation.Release(context.Background(), reservedSum); err != nil {
+				logEntry(r.Context(), logLevelError, "releasing key reservation failed", "error", err)
 			}
-			// If the buffer has the minimum required size or the current part is the last one,
-			// a new part is stored in the bucket.
-			uploadPartOutput, err := client.UploadPart(ctx, &s3.UploadPartInput{
-				Bucket:               multipartUploadOutput.Bucket,
-				Key:                  multipartUploadOutput.Key,
-				PartNumber:           partNumber,
-				UploadId:             multipartUploadOutput.UploadId,
-				Body:                 bytes.NewReader(buffer.Bytes()),
-				ContentLength:        int64(buffer.Len()),
-				ContentMD5:           nil,
-				ExpectedBucketOwner:  nil,
-				RequestPayer:         "",
-				SSECustomerAlgorithm: nil,
-				SSECustomerKey:       nil,
-				SSECustomerKeyMD5:    nil,
-			})
+		}()
+		// The upload holding the reservation before may have stored the same contents.
+		if deduplicate {
+			entry, ok, err := lookupDuplicate(ctx, declaredSum, resolveBucket(contentType), encryption, lock, storageClass)
 			if err != nil {
-				log.Print(err)
-				w.WriteHeader(http.StatusInternalServerError)
+				writeS3Error(w, r, err)
 				return
 			}
-			completedParts = append(completedParts, types.CompletedPart{
-				ETag:       uploadPartOutput.ETag,
-				PartNumber: partNumber,
-			})
-			// The buffer is empty to the next parts.
-			buffer.Reset()
-			partNumber++
-		}
-		completeMultipartUploadOutput, err := client.CompleteMultipartUpload(ctx,
-			&s3.CompleteMultipartUploadInput{
-				Bucket:              multipartUploadOutput.Bucket,
-				Key:                 multipartUploadOutput.Key,
-				UploadId:            multipartUploadOutput.UploadId,
-				ExpectedBucketOwner: nil,
-				MultipartUpload: &types.CompletedMultipartUpload{
-					Parts: completedParts,
-				},
-				RequestPayer: "",
-			})
+			if ok {
+				progress.complete(entry.Key)
+				writeMessage(w, r, http.StatusOK, Message{
+					Bucket:       entry.Bucket,
+					Key:          entry.Key,
+					Links:        duplicateLinks(ctx, entry),
+					Deduplicated: true,
+					SHA256:       declaredSum,
+				})
+				return
+			}
+		}
+	}
+	bucket := resolveBucket(contentType)
+	key := keyPrefix(r) + newKey(contentType)
+	uploadKey := stagedKey(key)
+	// The content hash is only known at the end of the stream, so the object is uploaded
+	// under a temporary key and copied to its hashed key afterwards.
+	if keyHashLength > 0 {
+		uploadKey = temporaryKeyPrefix + key
+	}
+	createStart := time.Now()
+	multipartUploadOutput, err := storage.CreateUpload(ctx, newCreateMultipartUploadInput(bucket, uploadKey, contentType,
+		withEncryption(encryption),
+		withObjectLock(lock),
+		withStorageClass(storageClass),
+		withTags(hints, tags),
+		withMetadata(metadata),
+		withChecksumSHA256(partChecksumSHA256),
+	))
+	health.observe(err, time.Since(createStart))
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	// Every failure until the upload is completed aborts it, so that its parts are not left
+	// in the bucket. The request context may be canceled by then.
+	completed := false
+	defer func() {
+		if !completed {
+			abortMultipartUpload(context.Background(), multipartUploadOutput)
+		}
+	}()
+	hash := sha256.New()
+	md5Hash := md5.New()
+	var destination io.Writer = hash
+	if storeContentHash {
+		destination = io.MultiWriter(hash, md5Hash)
+	}
+	// Staged uploads are not cached, as they must not be served before being confirmed, and
+	// neither are uploads encrypted with a customer key, whose contents would be stored in
+	// clear on disk.
+	var cacheWriter *cacheWriter
+	if cache != nil && !enableStaging && encryption.customerKey == nil {
+		cacheWriter, err = cache.writer()
 		if err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusCreated)
-		if err := json.NewEncoder(w).Encode(Message{
-			Key: *completeMultipartUploadOutput.Key,
-			Links: []Link{
-				{
-					URL: *completeMultipartUploadOutput.Location,
-				},
+			writeS3Error(w, r, err)
+			return
+		}
+		defer cacheWriter.discard()
+		destination = io.MultiWriter(destination, cacheWriter)
+	}
+	body := &headerRecorder{Reader: io.TeeReader(requestBody, destination)}
+	if reportDimensions {
+		body.limit = maxHeaderSize
+	}
+	partSize := partSizeFor(r.ContentLength, partSize)
+	partReader, err := newPartReader(partReaderStrategy, body, partSize)
+	if errors.Is(err, errUploadDuration) {
+		logEntry(r.Context(), logLevelInfo, "upload cut off", "error", err, "bytes", deadline.n)
+		writeUploadDuration(w)
+		return
+	} else if errors.Is(err, errContentTooLarge) {
+		writeContentTooLarge(w)
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	defer partReader.Close()
+	completedParts, size, err := uploadParts(ctx, partReader, multipartUploadOutput, encryption, expectedParts(r.ContentLength, partSize), progress)
+	if errors.Is(err, errUploadDuration) {
+		logEntry(r.Context(), logLevelInfo, "upload cut off", "error", err, "bytes", deadline.n)
+		writeUploadDuration(w)
+		return
+	} else if errors.Is(err, errContentTooLarge) {
+		writeContentTooLarge(w)
+		return
+	} else if errors.Is(err, errTooManyParts) {
+		writeError(w, http.StatusRequestEntityTooLarge, "entity_too_large", "too many parts")
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	rawSum := hash.Sum(nil)
+	sum := hex.EncodeToString(rawSum)
+	if declaredSum != "" && sum != declaredSum {
+		writeError(w, http.StatusBadRequest, "checksum_mismatch", "contents do not match X-Content-SHA256")
+		return
+	}
+	if declaredChecksum != "" && base64.StdEncoding.EncodeToString(rawSum) != declaredChecksum {
+		writeError(w, http.StatusUnprocessableEntity, "checksum_mismatch", "contents do not match X-Amz-Checksum-Sha256")
+		return
+	}
+	if deduplicate {
+		entry, ok, err := lookupDuplicate(ctx, sum, bucket, encryption, lock, storageClass)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		if ok {
+			progress.complete(entry.Key)
+			writeMessage(w, r, http.StatusOK, Message{
+				Bucket:       entry.Bucket,
+				Key:          entry.Key,
+				Links:        duplicateLinks(ctx, entry),
+				Deduplicated: true,
+				Size:         size,
+				SHA256:       sum,
+			})
+			return
+		}
+	}
+	completeStart := time.Now()
+	completeMultipartUploadOutput, err := storage.Complete(ctx,
+		&s3.CompleteMultipartUploadInput{
+			Bucket:              multipartUploadOutput.Bucket,
+			Key:                 multipartUploadOutput.Key,
+			UploadId:            multipartUploadOutput.UploadId,
+			ExpectedBucketOwner: nil,
+			MultipartUpload: &types.CompletedMultipartUpload{
+				Parts: completedParts,
 			},
+			RequestPayer:         "",
+			SSECustomerAlgorithm: encryption.customerAlgorithm,
+			SSECustomerKey:       encryption.customerKey,
+			SSECustomerKeyMD5:    encryption.customerKeyMD5,
+		})
+	health.observe(err, time.Since(completeStart))
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	completed = true
+	if partChecksumSHA256 {
+		err := verifyCompositeChecksum(ctx, completeMultipartUploadOutput, completedParts)
+		if errors.Is(err, errChecksumMismatch) {
+			writeError(w, http.StatusBadGateway, "checksum_mismatch", err.Error())
+			return
+		} else if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+	}
+	location := *completeMultipartUploadOutput.Location
+	versionID := aws.ToString(completeMultipartUploadOutput.VersionId)
+	var contentMD5 string
+	var replace *objectMetadata
+	if storeContentHash {
+		contentMD5 = base64.StdEncoding.EncodeToString(md5Hash.Sum(nil))
+		replace = &objectMetadata{
+			contentType: contentType,
+			metadata:    withContentHash(metadata, contentMD5, sum),
+		}
+	}
+	if keyHashLength > 0 {
+		hashedKey := hashedKey(key, sum, keyHashLength)
+		versionID, err = moveObject(ctx, bucket, uploadKey, stagedKey(hashedKey), size, encryption, lock, storageClass, replace)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		location = strings.TrimSuffix(location, uploadKey) + stagedKey(hashedKey)
+		key = hashedKey
+	}
+	// The metadata of an object can only be changed by copying it onto itself, which is
+	// skipped when it was just copied to its hashed key.
+	if replace != nil && keyHashLength == 0 {
+		versionID, err = copyObject(ctx, bucket, uploadKey, uploadKey, size, encryption, lock, storageClass, replace)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+	}
+	if verifyReadable {
+		if err := checkReadable(ctx, bucket, stagedKey(key), encryption); err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+	}
+	recentUploads.add(bucket, stagedKey(key))
+	links := []Link{
+		{
+			URL: objectURL(ctx, bucket, stagedKey(key), location),
+		},
+	}
+	var poster *Link
+	if companionPoster != nil {
+		poster, err = storePoster(ctx, bucket, stagedKey(key), location, companionPoster, encryption)
+	} else {
+		poster, err = attachPoster(ctx, bucket, stagedKey(key), location, contentType, encryption)
+	}
+	if err != nil {
+		writePosterError(w, r, err)
+		return
+	}
+	if poster != nil {
+		links = append(links, *poster)
+	}
+	// The object is only served from the cache once the upload can no longer be rejected.
+	if cacheWriter != nil {
+		if err := cacheWriter.commit(bucket, key, contentType); err != nil {
+			logEntry(r.Context(), logLevelError, "caching upload failed", "error", err)
+		}
+	}
+	var token string
+	if enableStaging {
+		// Staged objects are only indexed and notified once confirmed.
+		token, err = confirmToken()
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		object := stagedObject{
+			Bucket:       bucket,
+			Key:          key,
+			Location:     location,
+			Token:        token,
+			ContentType:  contentType,
+			Size:         size,
+			Hash:         sum,
+			Deduplicate:  deduplicate,
+			Callback:     callback,
+			Metadata:     metadata,
+			Encryption:   encryption,
+			Lock:         lock,
+			StorageClass: storageClass,
+			Poster:       poster != nil,
+			ExpiresAt:    time.Now().Add(stagingTTL),
+		}
+		object.Encryption.customerKey = nil
+		staged.put(object)
+		links = append(links, Link{
+			Rel: "confirm",
+			URL: stagedPath + "/" + key,
+		})
+	} else {
+		if deduplicate {
+			if err := dedupIndex.Add(ctx, sum, DedupEntry{Bucket: bucket, Key: key}); err != nil {
+				logEntry(ctx, logLevelError, "indexing duplicate failed", "error", err)
+			}
+		}
+		links = append(links, notifyUploaded(callback, Notification{
+			Bucket:      bucket,
+			Key:         key,
+			ContentType: contentType,
+			Size:        size,
+			Metadata:    metadata,
+			Links:       links,
+		})...)
+	}
+	message := Message{
+		Bucket:         bucket,
+		Key:            key,
+		Links:          links,
+		LifecycleHints: hints,
+		Tags:           tags,
+		Metadata:       metadata,
+		Size:           size,
+		SHA256:         sum,
+		MD5:            contentMD5,
+		VersionID:      versionID,
+		ConfirmToken:   token,
+	}
+	if enableStaging {
+		message.StagingKey = stagedKey(key)
+	}
+	if reportDimensions && strings.HasPrefix(contentType, "image/") {
+		message.Width, message.Height, _ = imageDimensions(body.header)
+	}
+	progress.complete(key)
+	writeMessage(w, r, http.StatusCreated, message)
+	return
+}
+
+// deleteFile deletes the object stored under key, in BUCKET or the bucket in the bucket query
+// parameter, with its poster. Only keys with the format of the generated ones are deleted.
+func deleteFile(w http.ResponseWriter, r *http.Request, key string) {
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		bucketName = bucket
+	}
+	if key == "" || !knownBucket(bucketName) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "missing key or unknown bucket")
+		return
+	}
+	if !validKey(key) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "the key was not generated by an upload")
+		return
+	}
+	if !ownsKey(r, key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	}
+	ctx := r.Context()
+	for _, key := range withPosterKey(key) {
+		if err := storage.Delete(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
 		}); err != nil {
-			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
+			writeS3Error(w, r, err)
 			return
 		}
+		forgetObject(bucketName, key)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withPosterKey returns the key followed by the key of its poster, when it may have one.
+func withPosterKey(key string) []string {
+	if ffmpegPath != "" && strings.HasPrefix(extensionContentType(path.Ext(key)), "video/") {
+		return []string{key, posterKey(key)}
+	}
+	return []string{key}
+}
+
+// forgetObject drops the presigned URLs and the cached copy of a deleted object.
+func forgetObject(bucket, key string) {
+	presignedURLs.invalidate(bucket, key)
+	if cache != nil {
+		cache.remove(bucket, key)
+	}
+}
+
+// presignDownload serves GET /api/v1/file?key={key}&bucket={bucket} with a presigned download
+// URL of the object, valid for PRESIGN_EXPIRY. The bucket defaults to BUCKET.
+func presignDownload(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	bucketName := r.URL.Query().Get("bucket")
+	if bucketName == "" {
+		bucketName = bucket
+	}
+	if key == "" || !knownBucket(bucketName) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "missing key or unknown bucket")
 		return
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+	if !ownsKey(r, key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	}
+	ctx := r.Context()
+	// Presigning does not check that the object exists.
+	if _, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(key),
+	}); err != nil {
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			writeError(w, http.StatusNotFound, "not_found", "no such key")
+			return
+		}
+		writeS3Error(w, r, err)
+		return
+	}
+	url, err := presignGetObject(ctx, bucketName, key, time.Now().Add(presignExpiry))
+	if err != nil {
+		writeS3Error(w, r, err)
 		return
 	}
+	writeMessage(w, r, http.StatusOK, Message{
+		Bucket: bucketName,
+		Key:    key,
+		Links: []Link{
+			{
+				Rel: "download",
+				URL: url,
+			},
+		},
+	})
+}
+
+// abortMultipartUpload aborts the multipart upload, so that the storage frees its parts.
+func abortMultipartUpload(ctx context.Context, output *s3.CreateMultipartUploadOutput) {
+	if err := storage.Abort(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   output.Bucket,
+		Key:      output.Key,
+		UploadId: output.UploadId,
+	}); err != nil {
+		logEntry(ctx, logLevelError, "aborting upload failed", "error", err)
+	}
+}
+
+// normalizeContentType returns the lowercased media type of a Content-Type header value, without
+// surrounding whitespace or parameters, so that "Video/MP4; codecs=avc1" matches "video/mp4".
+func normalizeContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+	}
+	return strings.ToLower(strings.TrimSpace(mediaType))
+}
+
+// acceptedContentType reports whether the content type starts with one of the prefixes.
+func acceptedContentType(contentType string, prefixes []string) bool {
+	if _, ok := keyExtensions[contentType]; restrictContentTypes && !ok {
+		return false
+	}
+	return hasContentTypePrefix(contentType, prefixes)
+}
+
+func hasContentTypePrefix(contentType string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(contentType, prefix) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSizeLimitReader(t *testing.T) {
+	tests := []struct {
+		body  string
+		limit int64
+		err   error
+	}{
+		{"", 0, nil},
+		{"abc", 3, nil},
+		{"abc", 10, nil},
+		{"abcd", 3, errContentTooLarge},
+		{"abc", 0, errContentTooLarge},
+	}
+	for _, test := range tests {
+		for _, reader := range []io.Reader{strings.NewReader(test.body), iotest.OneByteReader(strings.NewReader(test.body))} {
+			read, err := io.ReadAll(&sizeLimitReader{reader: reader, remaining: test.limit})
+			if !errors.Is(err, test.err) {
+				t.Errorf("%q limited to %d: got err %v, want %v", test.body, test.limit, err, test.err)
+			}
+			if int64(len(read)) > test.limit {
+				t.Errorf("%q limited to %d: read %d bytes", test.body, test.limit, len(read))
+			}
+		}
+	}
+}
+
+// failingStorage fails UploadPart or Complete, and counts the aborted uploads.
+type failingStorage struct {
+	filesystemStorage
+	failUploadPart bool
+	failComplete   bool
+	aborted        int
+}
+
+func (s *failingStorage) UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if s.failUploadPart {
+		return nil, errors.New("upload part failed")
+	}
+	return s.filesystemStorage.UploadPart(ctx, input)
+}
+
+func (s *failingStorage) Complete(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	if s.failComplete {
+		return nil, errors.New("complete failed")
+	}
+	return s.filesystemStorage.Complete(ctx, input)
+}
+
+func (s *failingStorage) Abort(ctx context.Context, input *s3.AbortMultipartUploadInput) error {
+	s.aborted++
+	return s.filesystemStorage.Abort(ctx, input)
+}
+
+func TestUploadFileAbortsFailedUploads(t *testing.T) {
+	defer func(s Storage, b string, size, maxSize int64) {
+		storage, bucket, partSize, maxContentSize = s, b, size, maxSize
+	}(storage, bucket, partSize, maxContentSize)
+	bucket, partSize, maxContentSize = "bucket", minUploadPartSize, 2*minUploadPartSize
+	body := "\x89PNG\r\n\x1a\n" + strings.Repeat("x", int(minUploadPartSize))
+	for _, s := range []*failingStorage{{failUploadPart: true}, {failComplete: true}} {
+		s.dir = t.TempDir()
+		storage = s
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/file", strings.NewReader(body))
+		r.Header.Set("Content-Type", "image/png")
+		w := httptest.NewRecorder()
+		uploadFile(w, r, nil)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("got status %d, want %d", w.Code, http.StatusInternalServerError)
+		}
+		if s.aborted != 1 {
+			t.Errorf("aborted %d times, want once", s.aborted)
+		}
+	}
+}
+
+// deleteCountingStorage counts the deleted objects.
+type deleteCountingStorage struct {
+	filesystemStorage
+	deleted int
+}
+
+func (s *deleteCountingStorage) Delete(ctx context.Context, input *s3.DeleteObjectInput) error {
+	s.deleted++
+	return s.filesystemStorage.Delete(ctx, input)
+}
+
+func TestDeleteFile(t *testing.T) {
+	defer func(s Storage, b string) { storage, bucket = s, b }(storage, bucket)
+	s := &deleteCountingStorage{filesystemStorage: filesystemStorage{dir: t.TempDir()}}
+	storage, bucket = s, "bucket"
+	const key = "0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50.png"
+	putFilesystemObject(t, s.filesystemStorage, key, "image/png", []byte(pngHeader))
+
+	w := httptest.NewRecorder()
+	fileHandler(w, httptest.NewRequest(http.MethodDelete, "/api/v1/file?key="+key, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	if _, err := s.Head(context.Background(), &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String(key)}); err == nil {
+		t.Error("the object was not deleted")
+	}
+
+	s.deleted = 0
+	for _, key := range []string{"", "../0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50.png", "report.png", "0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50.exe"} {
+		w := httptest.NewRecorder()
+		deleteFile(w, httptest.NewRequest(http.MethodDelete, "/api/v1/file?key="+url.QueryEscape(key), nil), key)
+		checkErrorResponse(t, w, http.StatusBadRequest, "invalid_key")
+	}
+	if s.deleted != 0 {
+		t.Errorf("deleted %d objects of invalid keys", s.deleted)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	filesPath         = "/api/v1/files"
+	maxListKeys int32 = 1000 // The most keys ListObjectsV2 returns at once.
+)
+
+type FileEntry struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"lastModified"`
+	ContentType  string    `json:"contentType,omitempty"` // From the key extension, empty when unknown.
+}
+
+type FileList struct {
+	Files                 []FileEntry `json:"files"`
+	NextContinuationToken string      `json:"nextContinuationToken,omitempty"`
+}
+
+// internalPrefixes returns the prefixes of the keys the service stores for itself: staged and
+// temporary objects, and the dedup index and upload sessions kept in the bucket.
+func internalPrefixes() []string {
+	prefixes := []string{stagingPrefix, temporaryKeyPrefix}
+	if index, ok := dedupIndex.(*s3DedupIndex); ok {
+		prefixes = append(prefixes, strings.TrimSuffix(index.prefix, "/")+"/")
+	}
+	if store, ok := uploadStore.(*s3UploadStore); ok {
+		prefixes = append(prefixes, strings.TrimSuffix(store.prefix, "/")+"/")
+	}
+	return prefixes
+}
+
+// listedKey reports whether the listing of prefix shows key. The keys under an internal prefix
+// are only listed when the prefix asks for them, and posters when the posters query parameter
+// is set.
+func listedKey(key, prefix string, posters bool) bool {
+	if strings.HasSuffix(key, posterSuffix) && !posters {
+		return false
+	}
+	for _, internal := range internalPrefixes() {
+		if strings.HasPrefix(key, internal) && !strings.HasPrefix(prefix, internal) {
+			return false
+		}
+	}
+	return true
+}
+
+// filesHandler serves GET /api/v1/files, listing the objects of BUCKET, or of the bucket in the
+// bucket query parameter, in key order. Only the buckets uploads are stored in may be listed.
+// The prefix query parameter filters the keys, max-keys limits the page to at most 1000 of them,
+// and continuation-token asks for the page following the one that answered it. The objects the
+// service stores for itself and the posters of videos are left out unless asked for, so pages
+// may hold fewer keys than max-keys. API keys only list their own objects.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	query := r.URL.Query()
+	bucketName := query.Get("bucket")
+	if bucketName == "" {
+		bucketName = bucket
+	}
+	if !knownBucket(bucketName) {
+		writeError(w, http.StatusBadRequest, "invalid_bucket", "unknown bucket")
+		return
+	}
+	maxKeys := maxListKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil || n < 1 || n > int64(maxListKeys) {
+			writeError(w, http.StatusBadRequest, "invalid_max_keys", "max-keys must be between 1 and 1000")
+			return
+		}
+		maxKeys = int32(n)
+	}
+	var posters bool
+	if v := query.Get("posters"); v != "" {
+		var err error
+		posters, err = strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid_posters", "posters must be true or false")
+			return
+		}
+	}
+	prefix := keyPrefix(r) + query.Get("prefix")
+	input := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucketName),
+		Prefix:  aws.String(prefix),
+		MaxKeys: maxKeys,
+	}
+	if token := query.Get("continuation-token"); token != "" {
+		input.ContinuationToken = aws.String(token)
+	}
+	output, err := storage.List(r.Context(), input)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	list := FileList{
+		Files: make([]FileEntry, 0, len(output.Contents)),
+	}
+	for _, object := range output.Contents {
+		key := aws.ToString(object.Key)
+		if !listedKey(key, prefix, posters) {
+			continue
+		}
+		list.Files = append(list.Files, FileEntry{
+			Key:          key,
+			Size:         object.Size,
+			LastModified: aws.ToTime(object.LastModified),
+			ContentType:  extensionContentType(path.Ext(key)),
+		})
+	}
+	if output.IsTruncated {
+		list.NextContinuationToken = aws.ToString(output.NextContinuationToken)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFilesHandlerHidesInternalKeys(t *testing.T) {
+	defer func(s Storage, name string, index DedupIndex) {
+		storage, bucket, dedupIndex = s, name, index
+	}(storage, bucket, dedupIndex)
+	s := filesystemStorage{dir: t.TempDir()}
+	storage, bucket = s, "bucket"
+	dedupIndex = &s3DedupIndex{bucket: "bucket", prefix: "dedup"}
+	for _, key := range []string{"a.png", "a.mp4", "a-poster.jpg", "staging/b.png", "tmp/c.png", "dedup/0123"} {
+		putFilesystemObject(t, s, key, "application/octet-stream", []byte(key))
+	}
+	tests := []struct {
+		query  string
+		status int
+		want   []string
+	}{
+		{"", http.StatusOK, []string{"a.mp4", "a.png"}},
+		{"?posters=true", http.StatusOK, []string{"a-poster.jpg", "a.mp4", "a.png"}},
+		{"?prefix=staging/", http.StatusOK, []string{"staging/b.png"}},
+		{"?prefix=tmp/", http.StatusOK, []string{"tmp/c.png"}},
+		{"?prefix=dedup/", http.StatusOK, []string{"dedup/0123"}},
+		{"?prefix=dedup", http.StatusOK, []string{}},
+		{"?posters=maybe", http.StatusBadRequest, nil},
+		{"?bucket=other", http.StatusBadRequest, nil},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		filesHandler(w, httptest.NewRequest(http.MethodGet, filesPath+test.query, nil))
+		if w.Code != test.status {
+			t.Errorf("%q: got status %d, want %d", test.query, w.Code, test.status)
+			continue
+		}
+		if test.status != http.StatusOK {
+			continue
+		}
+		var list FileList
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0, len(list.Files))
+		for _, file := range list.Files {
+			got = append(got, file.Key)
+		}
+		if !equalStrings(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.query, got, test.want)
+		}
+	}
+}
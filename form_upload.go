@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxFormFiles        = 10               // Files stored from a single form.
+	maxPosterSize int64 = 1024 * 1024 * 10 // 10 MB
+)
+
+// uploadForm stores every file of a multipart/form-data body, as browsers submit them, as its
+// own object. The form is streamed: each file is uploaded while it is read, and a "poster" field
+// holding a JPEG is stored as the poster of the video file following it.
+//
+// The response is a JSON array holding, in form order, the message or the error of each file.
+// The first failing file stops the upload of the following ones and gives its status to the
+// response.
+func uploadForm(w http.ResponseWriter, r *http.Request) {
+	// Declared checksums cover a single body, not the files of a form.
+	if r.Header.Get("X-Content-SHA256") != "" || r.Header.Get("X-Amz-Checksum-Sha256") != "" {
+		writeError(w, http.StatusBadRequest, "invalid_form", "checksums cannot be declared for form uploads")
+		return
+	}
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_form", err.Error())
+		return
+	}
+	statusCode := http.StatusOK
+	results := make([]json.RawMessage, 0, 1)
+	record := func(recorder *formRecorder) {
+		if recorder.statusCode > statusCode {
+			statusCode = recorder.statusCode
+		}
+		results = append(results, bytes.TrimSpace(recorder.body.Bytes()))
+	}
+	fail := func(status int, code, message string) {
+		recorder := newFormRecorder()
+		writeError(recorder, status, code, message)
+		record(recorder)
+	}
+	var poster []byte
+	for statusCode < http.StatusMultipleChoices {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			if poster != nil {
+				fail(http.StatusBadRequest, "invalid_form", "the poster is not followed by a video")
+			}
+			break
+		} else if err != nil {
+			fail(http.StatusBadRequest, "invalid_form", err.Error())
+			break
+		}
+		switch {
+		case part.FormName() == "poster":
+			poster, err = readPoster(part)
+			if errors.Is(err, errPosterTooLarge) {
+				fail(http.StatusRequestEntityTooLarge, "entity_too_large", "poster too large")
+			} else if errors.Is(err, errPosterNotJPEG) {
+				fail(http.StatusUnsupportedMediaType, "unsupported_media_type", "posters must be JPEG images")
+			} else if err != nil {
+				logEntry(r.Context(), logLevelError, "reading poster failed", "error", err)
+				fail(http.StatusBadRequest, "invalid_form", "the poster could not be read")
+			}
+		case part.FileName() == "":
+			// Other fields are ignored.
+		case len(results) == maxFormFiles:
+			fail(http.StatusRequestEntityTooLarge, "too_many_files", "too many files")
+		default:
+			contentType := normalizeContentType(part.Header.Get("Content-Type"))
+			if poster != nil && !strings.HasPrefix(contentType, "video/") {
+				fail(http.StatusBadRequest, "invalid_form", "the poster is not followed by a video")
+				break
+			}
+			recorder := newFormRecorder()
+			uploadFile(recorder, formFileRequest(r, part, contentType), poster)
+			record(recorder)
+			poster = nil
+		}
+		part.Close()
+	}
+	if len(results) == 0 {
+		writeError(w, http.StatusBadRequest, "invalid_form", "the form has no files")
+		return
+	}
+	contentType := "application/json"
+	if acceptsV2(r.Header.Get("Accept")) {
+		contentType = mediaTypeV2
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		logEntry(r.Context(), logLevelError, "writing response failed", "error", err)
+	}
+}
+
+var (
+	errPosterTooLarge = errors.New("poster too large")
+	errPosterNotJPEG  = errors.New("poster is not a JPEG image")
+)
+
+// readPoster reads the poster field of a form, which must hold a JPEG image.
+func readPoster(part *multipart.Part) ([]byte, error) {
+	poster, err := io.ReadAll(io.LimitReader(part, maxPosterSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(poster)) > maxPosterSize {
+		return nil, errPosterTooLarge
+	}
+	if http.DetectContentType(poster) != "image/jpeg" {
+		return nil, errPosterNotJPEG
+	}
+	return poster, nil
+}
+
+// formFileRequest returns the request uploading a file of the form, with its content type and an
+// unknown length.
+func formFileRequest(r *http.Request, part *multipart.Part, contentType string) *http.Request {
+	request := r.Clone(r.Context())
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Del("Content-Length")
+	// An upload ID tracks a single body.
+	request.Header.Del("X-Upload-Id")
+	request.ContentLength = -1
+	request.Body = io.NopCloser(part)
+	return request
+}
+
+// formRecorder records the response to the upload of a file of a form.
+type formRecorder struct {
+	header     http.Header
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newFormRecorder() *formRecorder {
+	return &formRecorder{header: make(http.Header)}
+}
+
+func (w *formRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *formRecorder) WriteHeader(statusCode int) {
+	if w.statusCode == 0 {
+		w.statusCode = statusCode
+	}
+}
+
+func (w *formRecorder) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	return w.body.Write(p)
+}
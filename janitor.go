@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log"
+	"strings"
+	"time"
+)
+
+// orphanedUploadTTL is the age after which multipart uploads left open by stopped instances are
+// aborted. Zero disables the janitor.
+var orphanedUploadTTL time.Duration
+
+// sweepMultipartUploads aborts the multipart uploads of the service older than ttl in every
+// bucket at each interval. Uploads of other keys of the buckets are left alone.
+func sweepMultipartUploads(ctx context.Context, interval, ttl time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			for _, bucket := range buckets() {
+				if err := abortMultipartUploadsBefore(ctx, bucket, t.Add(-ttl)); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+}
+
+func abortMultipartUploadsBefore(ctx context.Context, bucket string, t time.Time) error {
+	input := &s3.ListMultipartUploadsInput{Bucket: aws.String(bucket)}
+	for {
+		output, err := client.ListMultipartUploads(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, upload := range output.Uploads {
+			if upload.Initiated == nil || !upload.Initiated.Before(t) || !serviceUploadKey(aws.ToString(upload.Key)) {
+				continue
+			}
+			log.Printf("aborting multipart upload %s of %s initiated at %v", aws.ToString(upload.UploadId), aws.ToString(upload.Key), *upload.Initiated)
+			if err := storage.Abort(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			}); err != nil {
+				log.Print(err)
+			}
+		}
+		if !output.IsTruncated {
+			return nil
+		}
+		input.KeyMarker = output.NextKeyMarker
+		input.UploadIdMarker = output.NextUploadIdMarker
+	}
+}
+
+// serviceUploadKey reports whether a multipart upload of the key may have been started by the
+// service, under its final, temporary or staging key.
+func serviceUploadKey(key string) bool {
+	key = strings.TrimPrefix(key, temporaryKeyPrefix)
+	key = strings.TrimPrefix(key, stagingPrefix)
+	return validKey(key)
+}
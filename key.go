@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// temporaryKeyPrefix is where objects are stored while their final key is not known yet.
+const temporaryKeyPrefix = "tmp/"
+
+// keyExtensions maps the media types to the extension of their keys; others get no extension.
+var keyExtensions = map[string]string{
+	"image/avif":      ".avif",
+	"image/gif":       ".gif",
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"video/mpeg":      ".mpeg",
+	"video/ogg":       ".ogv",
+	"video/quicktime": ".mov",
+	"video/webm":      ".webm",
+}
+
+// restrictContentTypes limits the uploads to the media types of keyExtensions, when they are set
+// by CONTENT_TYPES.
+var restrictContentTypes bool
+
+// parseContentTypes parses comma separated media types, each optionally followed by the
+// extension of its keys, such as "image/png=.png,video/mp4=.mp4,image/heic".
+func parseContentTypes(s string) (map[string]string, error) {
+	extensions := make(map[string]string)
+	for _, entry := range strings.Split(s, ",") {
+		contentType, ext, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if contentType == "" || normalizeContentType(contentType) != contentType || !hasContentTypePrefix(contentType, contentTypes["/api/v1/file"]) {
+			return nil, fmt.Errorf("invalid CONTENT_TYPES media type %q", contentType)
+		}
+		if ext != "" && (len(ext) < 2 || ext[0] != '.' || strings.Trim(ext[1:], "abcdefghijklmnopqrstuvwxyz0123456789") != "") {
+			return nil, fmt.Errorf("invalid CONTENT_TYPES extension %q", ext)
+		}
+		extensions[contentType] = ext
+	}
+	return extensions, nil
+}
+
+// filenameExtension returns the key extension of a normalized content type.
+func filenameExtension(contentType string) string {
+	return keyExtensions[contentType]
+}
+
+// newKey returns a random key with the extension of the normalized content type.
+func newKey(contentType string) string {
+	return uuid.New().String() + filenameExtension(contentType)
+}
+
+// validKey reports whether the key has the format of the keys of uploads: an optional tenant
+// prefix, a UUID, optionally followed by the hash suffix of KEY_HASH_LENGTH, and the extension
+// of a known media type.
+func validKey(key string) bool {
+	key = trimTenantPrefix(key)
+	ext := path.Ext(key)
+	if ext != "" && extensionContentType(ext) == "" {
+		return false
+	}
+	name := strings.TrimSuffix(key, ext)
+	if len(name) < 36 {
+		return false
+	}
+	if _, err := uuid.Parse(name[:36]); err != nil {
+		return false
+	}
+	suffix := name[36:]
+	if suffix == "" {
+		return true
+	}
+	sum := strings.TrimPrefix(suffix, "-")
+	return len(sum) < len(suffix) && sum != "" && len(sum) <= sha256.Size*2 && strings.Trim(sum, "0123456789abcdef") == ""
+}
+
+// servedKey reports whether downloads may serve the object stored under key: an upload, or the
+// poster of one. Internal objects, such as staged uploads or the dedup index, are not served.
+func servedKey(key string) bool {
+	if strings.HasSuffix(key, posterSuffix) {
+		return validKey(strings.TrimSuffix(key, posterSuffix))
+	}
+	return validKey(key)
+}
+
+// extensionContentType returns the media type of a key extension, or "" when it is unknown.
+func extensionContentType(ext string) string {
+	for contentType, known := range keyExtensions {
+		if ext != "" && ext == known {
+			return contentType
+		}
+	}
+	return ""
+}
+
+// hashedKey inserts the first n characters of the hex encoded sum before the key's extension.
+func hashedKey(key, sum string, n int) string {
+	ext := path.Ext(key)
+	return strings.TrimSuffix(key, ext) + "-" + sum[:n] + ext
+}
+
+// objectMetadata replaces the content type and metadata of a copied object.
+type objectMetadata struct {
+	contentType string
+	metadata    map[string]string
+}
+
+// moveObject copies the object stored under src to dst and then deletes src, returning the
+// version ID of dst.
+func moveObject(ctx context.Context, bucket, src, dst string, size int64, encryption encryption, lock objectLock, storageClass types.StorageClass, replace *objectMetadata) (string, error) {
+	versionID, err := copyObject(ctx, bucket, src, dst, size, encryption, lock, storageClass, replace)
+	if err != nil {
+		return "", err
+	}
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(src),
+	}); err != nil {
+		return "", err
+	}
+	return versionID, nil
+}
+
+// copyObject copies the object stored under src to dst, which may be src itself, keeping its
+// encryption and retention. Amazon S3 stores copies in STANDARD unless they are given the
+// storage class of the source. Its metadata is kept as well, unless replace is not nil. It
+// returns the version ID of dst. Objects larger than CopyObject copies, per size, are copied
+// with copyLargeObject; size may be 0 for objects known to be small, such as posters.
+func copyObject(ctx context.Context, bucket, src, dst string, size int64, encryption encryption, lock objectLock, storageClass types.StorageClass, replace *objectMetadata) (string, error) {
+	presignedURLs.invalidate(bucket, src)
+	presignedURLs.invalidate(bucket, dst)
+	if size > maxCopyObjectSize {
+		head, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+			Bucket:               aws.String(bucket),
+			Key:                  aws.String(src),
+			SSECustomerAlgorithm: encryption.customerAlgorithm,
+			SSECustomerKey:       encryption.customerKey,
+			SSECustomerKeyMD5:    encryption.customerKeyMD5,
+		})
+		if err != nil {
+			return "", err
+		}
+		head.StorageClass = storageClass
+		if replace != nil {
+			head.ContentType = aws.String(replace.contentType)
+			head.Metadata = replace.metadata
+		}
+		return copyLargeObject(ctx, bucket, src, dst, head, encryption, lock)
+	}
+	input := &s3.CopyObjectInput{
+		Bucket:                         aws.String(bucket),
+		CopySource:                     aws.String(bucket + "/" + url.PathEscape(src)),
+		Key:                            aws.String(dst),
+		ObjectLockMode:                 lock.mode,
+		ObjectLockRetainUntilDate:      lock.retainUntil,
+		CopySourceSSECustomerAlgorithm: encryption.customerAlgorithm,
+		CopySourceSSECustomerKey:       encryption.customerKey,
+		CopySourceSSECustomerKeyMD5:    encryption.customerKeyMD5,
+		SSECustomerAlgorithm:           encryption.customerAlgorithm,
+		SSECustomerKey:                 encryption.customerKey,
+		SSECustomerKeyMD5:              encryption.customerKeyMD5,
+		SSEKMSKeyId:                    encryption.kmsKeyID,
+		SSEKMSEncryptionContext:        encryption.kmsContext,
+		ServerSideEncryption:           encryption.serverSideEncryption,
+		StorageClass:                   storageClass,
+	}
+	if replace != nil {
+		input.MetadataDirective = types.MetadataDirectiveReplace
+		input.ContentType = aws.String(replace.contentType)
+		input.Metadata = replace.metadata
+	}
+	output, err := client.CopyObject(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(output.VersionId), nil
+}
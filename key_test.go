@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServedKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50.png", true},
+		{"0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50", true},
+		{"0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50-9f86d0.png", true},
+		{"tenants/acme/0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50.png", true},
+		{"0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50-poster.jpg", true},
+		{"0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50-9f86d0-poster.jpg", true},
+		{"0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50.exe", false},
+		{"0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50-nothex.png", false},
+		{"staging/0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50.png", false},
+		{"dedup/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", false},
+		{"uploads/0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50", false},
+		{"-poster.jpg", false},
+		{"report.png", false},
+	}
+	for _, test := range tests {
+		if got := servedKey(test.key); got != test.want {
+			t.Errorf("servedKey(%q) = %t, want %t", test.key, got, test.want)
+		}
+	}
+}
+
+func TestFilenameExtension(t *testing.T) {
+	for contentType, want := range keyExtensions {
+		upper := strings.ToUpper(contentType)
+		for _, header := range []string{
+			contentType,
+			" " + contentType + " ",
+			upper,
+			contentType + "; charset=binary",
+			upper + ` ; codecs="avc1.42E01E, mp4a.40.2"`,
+			contentType + ";",
+		} {
+			if got := filenameExtension(normalizeContentType(header)); got != want {
+				t.Errorf("extension of %q = %q, want %q", header, got, want)
+			}
+		}
+	}
+	if got := filenameExtension(normalizeContentType("application/octet-stream")); got != "" {
+		t.Errorf("extension of an unknown type = %q, want none", got)
+	}
+}
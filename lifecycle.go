@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// lifecycleVocabulary lists the allowed values of each lifecycle hint tag. Operators pair these
+// tags with the bucket lifecycle rules that act on them.
+var (
+	lifecycleVocabulary = map[string][]string{
+		"tier": {"standard", "infrequent", "archive"},
+		"ttl":  {"7d", "30d", "90d", "365d"},
+	}
+	defaultLifecycleHints map[string]string
+)
+
+// parseLifecycleVocabulary parses "tag=value|value,tag=value" pairs.
+func parseLifecycleVocabulary(s string) (map[string][]string, error) {
+	vocabulary := make(map[string][]string)
+	for _, pair := range strings.Split(s, ",") {
+		tag, values, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || tag == "" || values == "" {
+			return nil, fmt.Errorf("invalid lifecycle vocabulary entry %q", pair)
+		}
+		vocabulary[tag] = strings.Split(values, "|")
+	}
+	return vocabulary, nil
+}
+
+// parseLifecycleHints parses "tag=value" pairs and validates them against the vocabulary.
+func parseLifecycleHints(s string) (map[string]string, error) {
+	hints := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		tag, value, _ := strings.Cut(pair, "=")
+		if !allowedLifecycleHint(tag, value) {
+			return nil, fmt.Errorf("lifecycle hint %q is not allowed", pair)
+		}
+		hints[tag] = value
+	}
+	return hints, nil
+}
+
+func allowedLifecycleHint(tag, value string) bool {
+	for _, allowed := range lifecycleVocabulary[tag] {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// lifecycleHints merges the X-Lifecycle-Hints header over the default hints.
+func lifecycleHints(header string) (map[string]string, error) {
+	hints, err := parseLifecycleHints(header)
+	if err != nil {
+		return nil, err
+	}
+	for tag, value := range defaultLifecycleHints {
+		if _, ok := hints[tag]; !ok {
+			hints[tag] = value
+		}
+	}
+	return hints, nil
+}
+
+// tagging encodes tags as the URL query string expected by the Tagging field,
+// or returns nil when there are none.
+func tagging(tags map[string]string) *string {
+	if len(tags) == 0 {
+		return nil
+	}
+	values := make(url.Values, len(tags))
+	for key, value := range tags {
+		values.Set(key, value)
+	}
+	s := values.Encode()
+	return &s
+}
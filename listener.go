@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// limitListener returns a listener that accepts at most n simultaneous connections.
+// Once the limit is reached, Accept blocks until one of the active connections is closed,
+// so excess connections wait in the kernel backlog instead of consuming file descriptors.
+func limitListener(l net.Listener, n int) net.Listener {
+	return &limitedListener{
+		Listener:  l,
+		semaphore: make(chan struct{}, n),
+		done:      make(chan struct{}),
+	}
+}
+
+type limitedListener struct {
+	net.Listener
+	semaphore chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	select {
+	case l.semaphore <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.semaphore
+		return nil, err
+	}
+	return &limitedConn{Conn: conn, release: func() { <-l.semaphore }}, nil
+}
+
+func (l *limitedListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+	return err
+}
+
+type limitedConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// healthMonitor tracks the error rate and latency of recent Amazon S3 calls and sheds new
+// uploads while they exceed their thresholds. In-flight uploads are never interrupted.
+type healthMonitor struct {
+	maxErrorRate float64       // Zero disables the error rate threshold.
+	maxLatency   time.Duration // Zero disables the latency threshold.
+	minCalls     int           // Calls needed in the window before the thresholds apply.
+	cooldown     time.Duration // How long uploads are shed before the service recovers.
+
+	mu        sync.Mutex
+	buckets   []healthBucket // One bucket per second of the window.
+	shedUntil time.Time
+}
+
+type healthBucket struct {
+	second  int64
+	calls   int
+	errors  int
+	latency time.Duration
+}
+
+var health = newHealthMonitor(time.Minute)
+
+func newHealthMonitor(window time.Duration) *healthMonitor {
+	seconds := int(window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &healthMonitor{
+		minCalls: 20,
+		cooldown: 30 * time.Second,
+		buckets:  make([]healthBucket, seconds),
+	}
+}
+
+// enabled reports whether any threshold is configured.
+func (m *healthMonitor) enabled() bool {
+	return m.maxErrorRate > 0 || m.maxLatency > 0
+}
+
+// observe records the outcome of an Amazon S3 call. Only server-side failures count as errors.
+func (m *healthMonitor) observe(err error, latency time.Duration) {
+	if !m.enabled() || errors.Is(err, context.Canceled) {
+		return
+	}
+	second := time.Now().Unix()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bucket := &m.buckets[second%int64(len(m.buckets))]
+	if bucket.second != second {
+		*bucket = healthBucket{second: second}
+	}
+	bucket.calls++
+	bucket.latency += latency
+	if serverError(err) {
+		bucket.errors++
+	}
+}
+
+// shed reports whether new uploads must be rejected, and for how long.
+func (m *healthMonitor) shed() (bool, time.Duration) {
+	if !m.enabled() {
+		return false, 0
+	}
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Before(m.shedUntil) {
+		return true, m.shedUntil.Sub(now)
+	}
+	var calls, errs int
+	var latency time.Duration
+	for _, bucket := range m.buckets {
+		if now.Unix()-bucket.second < int64(len(m.buckets)) {
+			calls += bucket.calls
+			errs += bucket.errors
+			latency += bucket.latency
+		}
+	}
+	if calls < m.minCalls {
+		return false, 0
+	}
+	unhealthy := m.maxErrorRate > 0 && float64(errs)/float64(calls) > m.maxErrorRate
+	unhealthy = unhealthy || m.maxLatency > 0 && latency/time.Duration(calls) > m.maxLatency
+	if !unhealthy {
+		return false, 0
+	}
+	// The window restarts empty, so recovery is judged only on calls made after the cooldown.
+	m.shedUntil = now.Add(m.cooldown)
+	for i := range m.buckets {
+		m.buckets[i] = healthBucket{}
+	}
+	return true, m.cooldown
+}
+
+// serverError reports whether err is a throttling, 5xx or transport failure of Amazon S3.
+func serverError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var responseError *awshttp.ResponseError
+	if errors.As(err, &responseError) {
+		statusCode := responseError.HTTPStatusCode()
+		return statusCode >= http.StatusInternalServerError || statusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// writeShed responds 503 with a Retry-After header when uploads are being shed.
+func writeShed(w http.ResponseWriter) bool {
+	shed, retryAfter := health.shed()
+	if !shed {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, http.StatusServiceUnavailable, "overloaded", "uploads are shed, retry later")
+	return true
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats selectable through LOG_FORMAT.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// Log levels, of which LOG_LEVEL selects info or debug. Errors are always logged.
+const (
+	logLevelError = "error"
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+)
+
+var (
+	logJSON  bool // Whether every entry is written as a JSON object on its own line.
+	logDebug bool // Whether the debug entries, such as the upload of each part, are written.
+)
+
+// maxRequestIDLength bounds the X-Request-ID accepted from clients.
+const maxRequestIDLength = 128
+
+var (
+	logMu     sync.Mutex
+	logOutput io.Writer = os.Stderr
+)
+
+type requestIDContextKey struct{}
+
+// requestID returns the ID of the request ctx belongs to, empty outside of requests.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// logEntry writes an entry of the level with the message, the ID of the request of ctx, and
+// the fields, alternating keys and values. Fields whose value is nil, such as a nil error, are
+// left out.
+func logEntry(ctx context.Context, level, msg string, fields ...interface{}) {
+	if level == logLevelDebug && !logDebug {
+		return
+	}
+	id := requestID(ctx)
+	if !logJSON {
+		var b strings.Builder
+		b.WriteString(msg)
+		if id != "" {
+			fmt.Fprintf(&b, " requestId=%s", id)
+		}
+		for i := 0; i+1 < len(fields); i += 2 {
+			if fields[i+1] != nil {
+				fmt.Fprintf(&b, " %v=%v", fields[i], fields[i+1])
+			}
+		}
+		log.Print(b.String())
+		return
+	}
+	entry := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": level,
+		"msg":   msg,
+	}
+	if id != "" {
+		entry["requestId"] = id
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		value := fields[i+1]
+		if value == nil {
+			continue
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[fmt.Sprint(fields[i])] = value
+	}
+	writeJSONEntry(entry)
+}
+
+func writeJSONEntry(entry map[string]interface{}) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{"level": "error", "msg": err.Error()})
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	logOutput.Write(append(line, '\n'))
+}
+
+// jsonLogWriter is the output of the standard logger in the JSON format, wrapping each line it
+// writes in an entry, so that every log.Print call writes JSON too.
+type jsonLogWriter struct{}
+
+func (jsonLogWriter) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		writeJSONEntry(map[string]interface{}{
+			"time":  time.Now().UTC().Format(time.RFC3339Nano),
+			"level": logLevelInfo,
+			"msg":   string(line),
+		})
+	}
+	return len(p), nil
+}
+
+// setLogFormat makes the standard logger write the format.
+func setLogFormat(format string) error {
+	switch format {
+	case logFormatText:
+		logJSON = false
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(logOutput)
+	case logFormatJSON:
+		logJSON = true
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{})
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT %q", format)
+	}
+	return nil
+}
+
+// validRequestID reports whether a client chosen X-Request-ID can be logged as is: 1 to 128
+// printable ASCII characters.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// logRequests gives every request an ID, the X-Request-ID of the request when valid and a
+// random UUID otherwise, which is answered in X-Request-ID and added to the entries logEntry
+// writes for the request. Each request is logged once answered, with its method, path, status code, body and
+// response sizes, and duration.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", id)
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		logEntry(ctx, logLevelInfo, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.statusCode,
+			"requestBytes", body.n,
+			"responseBytes", recorder.bytes,
+			"durationMs", time.Since(start).Milliseconds(),
+		)
+	})
+}
@@ -2,31 +2,562 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 var (
-	client *s3.Client
-	bucket = os.Getenv("BUCKET")
+	client         *s3.Client
+	bucket         string
+	maxConnections int // Zero means no limit.
+	keyHashLength  int // Zero disables the content hash suffix.
+	bucketRoutes   []bucketRoute
+	sessionTTL     = time.Hour
+	// allowedEncryption lists the encryption modes clients may select with X-Encryption.
+	allowedEncryption = []string{encryptionNone, encryptionS3}
+	// partReaderStrategy selects how parts are buffered before they are uploaded.
+	partReaderStrategy = partReaderMemory
+	emitEMFMetrics     bool
 )
 
-func init() {
+// configure reads the configuration of the service from the environment, exiting on invalid
+// values. It runs from main rather than init, so that the tests do not need a configuration.
+func configure() {
 	ctx := context.Background()
-	cfg, err := config.LoadDefaultConfig(ctx)
+	if v := os.Getenv("LOG_FORMAT"); v != "" {
+		if err := setLogFormat(v); err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch v := os.Getenv("LOG_LEVEL"); v {
+	case "", logLevelInfo:
+	case logLevelDebug:
+		logDebug = true
+	default:
+		log.Fatalf("invalid LOG_LEVEL %q", v)
+	}
+	if v := os.Getenv("RETRYABLE_ERROR_CODES"); v != "" {
+		retryableErrorCodes = parseErrorCodes(v)
+	}
+	if v := os.Getenv("RETRYABLE_STATUS_CODES"); v != "" {
+		var err error
+		retryableStatusCodes, err = parseStatusCodes(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	settings, err := loadConfig(os.Getenv)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	bucket = settings.bucket
+	partSize = settings.partSize
+	maxContentSize = settings.maxContentSize
+	// The client copies the retryer settings when it is created.
+	if v := os.Getenv("S3_MAX_ATTEMPTS"); v != "" {
+		maxAttempts, err = strconv.Atoi(v)
+		if err != nil || maxAttempts < 1 {
+			log.Fatalf("invalid S3_MAX_ATTEMPTS %q", v)
+		}
+	}
+	options := []func(*config.LoadOptions) error{config.WithRetryer(newRetryer)}
+	if settings.region != "" {
+		options = append(options, config.WithRegion(settings.region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
 	if err != nil {
 		log.Fatal(err)
 	}
-	client = s3.NewFromConfig(cfg)
+	client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+		// S3_ENDPOINT points the client to an S3 compatible store, such as MinIO.
+		if v := os.Getenv("S3_ENDPOINT"); v != "" {
+			o.EndpointResolver = s3.EndpointResolverFromURL(v)
+		}
+		if v := os.Getenv("S3_FORCE_PATH_STYLE"); v != "" {
+			forcePathStyle, err := strconv.ParseBool(v)
+			if err != nil {
+				log.Fatalf("invalid S3_FORCE_PATH_STYLE %q", v)
+			}
+			o.UsePathStyle = forcePathStyle
+		}
+	})
+	if v := os.Getenv("S3_ERROR_STATUS_CODES"); v != "" {
+		codes, err := parseErrorStatusCodes(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for code, statusCode := range codes {
+			s3ErrorStatusCodes[code] = statusCode
+		}
+	}
+	if v := os.Getenv("PART_CHECKSUM_SHA256"); v != "" {
+		partChecksumSHA256, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid PART_CHECKSUM_SHA256 %q", v)
+		}
+	}
+	if v := os.Getenv("MAX_PART_RETRIES"); v != "" {
+		maxPartRetries, err = strconv.Atoi(v)
+		if err != nil || maxPartRetries < 0 {
+			log.Fatalf("invalid MAX_PART_RETRIES %q", v)
+		}
+	}
+	if v := os.Getenv("SHUTDOWN_TIMEOUT"); v != "" {
+		shutdownTimeout, err = time.ParseDuration(v)
+		if err != nil || shutdownTimeout < 0 {
+			log.Fatalf("invalid SHUTDOWN_TIMEOUT %q", v)
+		}
+	}
+	if v := os.Getenv("MAX_CONNECTIONS"); v != "" {
+		maxConnections, err = strconv.Atoi(v)
+		if err != nil || maxConnections < 0 {
+			log.Fatalf("invalid MAX_CONNECTIONS %q", v)
+		}
+	}
+	if v := os.Getenv("KEY_HASH_LENGTH"); v != "" {
+		keyHashLength, err = strconv.Atoi(v)
+		if err != nil || keyHashLength < 0 || keyHashLength > sha256.Size*2 {
+			log.Fatalf("invalid KEY_HASH_LENGTH %q", v)
+		}
+	}
+	if v := os.Getenv("GLOBAL_MAX_BYTES_PER_SEC"); v != "" {
+		rate, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || rate < 1 {
+			log.Fatalf("invalid GLOBAL_MAX_BYTES_PER_SEC %q", v)
+		}
+		uploadRate = newTokenBucket(float64(rate))
+	}
+	if v := os.Getenv("MAX_CONCURRENT_UPLOADS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid MAX_CONCURRENT_UPLOADS %q", v)
+		}
+		uploadSlots = make(chan struct{}, n)
+	}
+	if v := os.Getenv("RATE_LIMIT_PER_IP"); v != "" {
+		rate, err := strconv.Atoi(v)
+		if err != nil || rate < 1 {
+			log.Fatalf("invalid RATE_LIMIT_PER_IP %q", v)
+		}
+		clientRate = newClientLimits(float64(rate))
+	}
+	if v := os.Getenv("TRUST_X_FORWARDED_FOR"); v != "" {
+		trustForwardedFor, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid TRUST_X_FORWARDED_FOR %q", v)
+		}
+	}
+	if v := os.Getenv("MAX_UPLOAD_DURATION"); v != "" {
+		maxUploadDuration, err = time.ParseDuration(v)
+		if err != nil || maxUploadDuration < 0 {
+			log.Fatalf("invalid MAX_UPLOAD_DURATION %q", v)
+		}
+	}
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		sessionTTL, err = time.ParseDuration(v)
+		if err != nil || sessionTTL <= 0 {
+			log.Fatalf("invalid SESSION_TTL %q", v)
+		}
+	}
+	if v := os.Getenv("ORPHANED_UPLOAD_TTL"); v != "" {
+		orphanedUploadTTL, err = time.ParseDuration(v)
+		if err != nil || orphanedUploadTTL < 0 {
+			log.Fatalf("invalid ORPHANED_UPLOAD_TTL %q", v)
+		}
+		// Sessions keep their multipart upload open until they expire.
+		if orphanedUploadTTL > 0 && orphanedUploadTTL <= sessionTTL {
+			log.Fatalf("ORPHANED_UPLOAD_TTL %q must exceed SESSION_TTL", v)
+		}
+	}
+	if v := os.Getenv("CONSISTENCY_WINDOW"); v != "" {
+		consistencyWindow, err = time.ParseDuration(v)
+		if err != nil || consistencyWindow < 0 {
+			log.Fatalf("invalid CONSISTENCY_WINDOW %q", v)
+		}
+	}
+	if v := os.Getenv("CONTENT_TYPES"); v != "" {
+		keyExtensions, err = parseContentTypes(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		restrictContentTypes = true
+	}
+	if v := os.Getenv("ALLOWED_ENCRYPTION"); v != "" {
+		allowedEncryption = nil
+		for _, mode := range strings.Split(v, ",") {
+			switch mode = strings.TrimSpace(mode); mode {
+			case encryptionNone, encryptionS3, encryptionKMS, encryptionCustomer:
+				allowedEncryption = append(allowedEncryption, mode)
+			default:
+				log.Fatalf("invalid ALLOWED_ENCRYPTION %q", v)
+			}
+		}
+	}
+	if v := os.Getenv("STORAGE_CLASS"); v != "" {
+		defaultStorageClass, err = parseStorageClass(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if v := os.Getenv("SSE_MODE"); v != "" {
+		defaultEncryption, err = parseSSEMode(v, os.Getenv("SSE_KMS_KEY_ID"), os.Getenv("SSE_KMS_ENCRYPTION_CONTEXT"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if os.Getenv("ALLOWED_ENCRYPTION") == "" {
+			allowedEncryption = withoutWeakerEncryption(allowedEncryption, defaultEncryption.mode)
+		}
+	}
+	if v := os.Getenv("UPLOAD_CONCURRENCY"); v != "" {
+		uploadConcurrency, err = strconv.Atoi(v)
+		if err != nil || uploadConcurrency < 1 {
+			log.Fatalf("invalid UPLOAD_CONCURRENCY %q", v)
+		}
+	}
+	if v := os.Getenv("PART_READER"); v != "" {
+		switch v {
+		case partReaderMemory, partReaderDisk, partReaderRanged:
+			partReaderStrategy = v
+		default:
+			log.Fatalf("invalid PART_READER %q", v)
+		}
+	}
+	if v := os.Getenv("EMIT_EMF"); v != "" {
+		emitEMFMetrics, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid EMIT_EMF %q", v)
+		}
+	}
+	if v := os.Getenv("VERIFY_READABLE"); v != "" {
+		verifyReadable, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid VERIFY_READABLE %q", v)
+		}
+	}
+	if v := os.Getenv("REPORT_DIMENSIONS"); v != "" {
+		reportDimensions, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid REPORT_DIMENSIONS %q", v)
+		}
+	}
+	if v := os.Getenv("ENABLE_TRANSCODE"); v != "" {
+		enableTranscode, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid ENABLE_TRANSCODE %q", v)
+		}
+	}
+	if v := os.Getenv("TRANSCODE_QUALITY"); v != "" {
+		transcodeQuality, err = strconv.Atoi(v)
+		if err != nil || transcodeQuality < 1 || transcodeQuality > 100 {
+			log.Fatalf("invalid TRANSCODE_QUALITY %q", v)
+		}
+	}
+	if v := os.Getenv("MAX_DECODE_PIXELS"); v != "" {
+		maxDecodePixels, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || maxDecodePixels < 1 {
+			log.Fatalf("invalid MAX_DECODE_PIXELS %q", v)
+		}
+	}
+	ffmpegPath = os.Getenv("FFMPEG_PATH")
+	if v := os.Getenv("REQUIRE_POSTER"); v != "" {
+		requirePoster, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid REQUIRE_POSTER %q", v)
+		}
+	}
+	if v := os.Getenv("EMF_NAMESPACE"); v != "" {
+		emfNamespace = v
+	}
+	if v := os.Getenv("SHED_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window < time.Second {
+			log.Fatalf("invalid SHED_WINDOW %q", v)
+		}
+		health = newHealthMonitor(window)
+	}
+	if v := os.Getenv("SHED_ERROR_RATE"); v != "" {
+		health.maxErrorRate, err = strconv.ParseFloat(v, 64)
+		if err != nil || health.maxErrorRate < 0 || health.maxErrorRate > 1 {
+			log.Fatalf("invalid SHED_ERROR_RATE %q", v)
+		}
+	}
+	if v := os.Getenv("SHED_LATENCY"); v != "" {
+		health.maxLatency, err = time.ParseDuration(v)
+		if err != nil || health.maxLatency < 0 {
+			log.Fatalf("invalid SHED_LATENCY %q", v)
+		}
+	}
+	if v := os.Getenv("SHED_MIN_CALLS"); v != "" {
+		health.minCalls, err = strconv.Atoi(v)
+		if err != nil || health.minCalls < 1 {
+			log.Fatalf("invalid SHED_MIN_CALLS %q", v)
+		}
+	}
+	if v := os.Getenv("SHED_COOLDOWN"); v != "" {
+		health.cooldown, err = time.ParseDuration(v)
+		if err != nil || health.cooldown <= 0 {
+			log.Fatalf("invalid SHED_COOLDOWN %q", v)
+		}
+	}
+	webhookURL = os.Getenv("WEBHOOK_URL")
+	if v := os.Getenv("CALLBACK_URL_PREFIXES"); v != "" {
+		for _, prefix := range strings.Split(v, ",") {
+			u, err := parseCallbackURL(prefix)
+			if err != nil || u.RawQuery != "" || u.Fragment != "" {
+				log.Fatalf("invalid CALLBACK_URL_PREFIXES %q", v)
+			}
+			callbackURLPrefixes = append(callbackURLPrefixes, u)
+		}
+	}
+	if v := os.Getenv("EVENT_SQS_QUEUE_URL"); v != "" {
+		eventPublishers = append(eventPublishers, sqsPublisher{client: sqs.NewFromConfig(cfg), queueURL: v})
+	}
+	if v := os.Getenv("EVENT_SNS_TOPIC_ARN"); v != "" {
+		eventPublishers = append(eventPublishers, snsPublisher{client: sns.NewFromConfig(cfg), topicARN: v})
+	}
+	deadLetterLocation = os.Getenv("DEAD_LETTER_LOCATION")
+	if v := os.Getenv("MAX_DELIVERY_ATTEMPTS"); v != "" {
+		maxDeliveryAttempts, err = strconv.Atoi(v)
+		if err != nil || maxDeliveryAttempts < 1 {
+			log.Fatalf("invalid MAX_DELIVERY_ATTEMPTS %q", v)
+		}
+	}
+	tokenSecret = []byte(os.Getenv("TOKEN_SECRET"))
+	tokenIssuerSecret = []byte(os.Getenv("TOKEN_ISSUER_SECRET"))
+	if v := os.Getenv("TOKEN_MAX_TTL"); v != "" {
+		tokenMaxTTL, err = time.ParseDuration(v)
+		if err != nil || tokenMaxTTL <= 0 {
+			log.Fatalf("invalid TOKEN_MAX_TTL %q", v)
+		}
+	}
+	if v := os.Getenv("PRESIGN_EXPIRY"); v != "" {
+		presignExpiry, err = time.ParseDuration(v)
+		if err != nil || presignExpiry <= 0 {
+			log.Fatalf("invalid PRESIGN_EXPIRY %q", v)
+		}
+	}
+	if v := os.Getenv("PRESIGN_CACHE_WINDOW"); v != "" {
+		presignCacheWindow, err = time.ParseDuration(v)
+		if err != nil || presignCacheWindow < 0 {
+			log.Fatalf("invalid PRESIGN_CACHE_WINDOW %q", v)
+		}
+	}
+	if v := os.Getenv("PRESIGN_CACHE_SIZE"); v != "" {
+		presignCacheSize, err = strconv.Atoi(v)
+		if err != nil || presignCacheSize < 1 {
+			log.Fatalf("invalid PRESIGN_CACHE_SIZE %q", v)
+		}
+	}
+	if v := os.Getenv("LIFECYCLE_HINT_VOCABULARY"); v != "" {
+		lifecycleVocabulary, err = parseLifecycleVocabulary(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	defaultLifecycleHints, err = parseLifecycleHints(os.Getenv("DEFAULT_LIFECYCLE_HINTS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if v := os.Getenv("ENABLE_STAGING"); v != "" {
+		enableStaging, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid ENABLE_STAGING %q", v)
+		}
+	}
+	if v := os.Getenv("STAGING_PREFIX"); v != "" {
+		stagingPrefix = strings.TrimSuffix(v, "/") + "/"
+	}
+	if v := os.Getenv("STAGING_TTL"); v != "" {
+		stagingTTL, err = time.ParseDuration(v)
+		if err != nil || stagingTTL <= 0 {
+			log.Fatalf("invalid STAGING_TTL %q", v)
+		}
+	}
+	if v := os.Getenv("CACHE_DIR"); v != "" {
+		maxSize := int64(1 << 30)
+		if v := os.Getenv("CACHE_MAX_SIZE"); v != "" {
+			maxSize, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || maxSize <= 0 {
+				log.Fatalf("invalid CACHE_MAX_SIZE %q", v)
+			}
+		}
+		cache, err = newDiskCache(v, maxSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if v := os.Getenv("DEFAULT_METADATA"); v != "" {
+		defaultMetadata, err = parseMetadata(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if v := os.Getenv("STORE_CONTENT_HASH"); v != "" {
+		storeContentHash, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid STORE_CONTENT_HASH %q", v)
+		}
+	}
+	switch v := os.Getenv("DEDUP_INDEX"); v {
+	case "":
+	case dedupIndexMemory:
+		dedupIndex = newMemoryDedupIndex()
+	case dedupIndexS3:
+		prefix := "dedup"
+		if v := os.Getenv("DEDUP_INDEX_PREFIX"); v != "" {
+			prefix = v
+		}
+		dedupIndex = &s3DedupIndex{bucket: bucket, prefix: prefix}
+	default:
+		log.Fatalf("invalid DEDUP_INDEX %q", v)
+	}
+	if v := os.Getenv("API_KEYS_FILE"); v != "" {
+		apiKeys, err = loadAPIKeys(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	switch v := os.Getenv("STORAGE"); v {
+	case "", storageS3:
+	case storageFilesystem:
+		dir := os.Getenv("STORAGE_DIR")
+		if dir == "" {
+			log.Fatal("missing STORAGE_DIR")
+		}
+		storage = filesystemStorage{dir: dir}
+		storageBackend = storageFilesystem
+		// Presigned URLs point to Amazon S3, which does not hold the files of the filesystem storage.
+		presignLinks = false
+	default:
+		log.Fatalf("invalid STORAGE %q", v)
+	}
+	storage = meteredStorage{storage}
+	if v := os.Getenv("PRESIGN_LINKS"); v != "" {
+		presignLinks, err = strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("invalid PRESIGN_LINKS %q", v)
+		}
+	}
+	switch v := os.Getenv("UPLOAD_STORE"); v {
+	case "", uploadStoreMemory:
+	case uploadStoreS3:
+		prefix := "uploads"
+		if v := os.Getenv("UPLOAD_STORE_PREFIX"); v != "" {
+			prefix = v
+		}
+		uploadStore = &s3UploadStore{bucket: bucket, prefix: prefix}
+	default:
+		log.Fatalf("invalid UPLOAD_STORE %q", v)
+	}
+	switch v := os.Getenv("KEY_RESERVATION"); v {
+	case "":
+	case keyReservationMemory:
+		keyReservation = newMemoryKeyReservation()
+	case keyReservationDynamoDB:
+		table := os.Getenv("KEY_RESERVATION_TABLE")
+		if table == "" {
+			log.Fatal("missing KEY_RESERVATION_TABLE")
+		}
+		keyReservation = newDynamoDBKeyReservation(dynamodb.NewFromConfig(cfg), table)
+	default:
+		log.Fatalf("invalid KEY_RESERVATION %q", v)
+	}
+	if v := os.Getenv("KEY_RESERVATION_TTL"); v != "" {
+		keyReservationTTL, err = time.ParseDuration(v)
+		if err != nil || keyReservationTTL <= 0 {
+			log.Fatalf("invalid KEY_RESERVATION_TTL %q", v)
+		}
+	}
+	if v := os.Getenv("KEY_RESERVATION_WAIT"); v != "" {
+		keyReservationWait, err = time.ParseDuration(v)
+		if err != nil || keyReservationWait < 0 {
+			log.Fatalf("invalid KEY_RESERVATION_WAIT %q", v)
+		}
+	}
+	bucketRoutes, err = parseBucketRoutes(os.Getenv("BUCKET_ROUTES"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if v := os.Getenv("DEFAULT_OBJECT_LOCK_MODE"); v != "" {
+		defaultObjectLockMode, err = parseObjectLockMode(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defaultRetentionDuration, err = parseRetentionDuration(os.Getenv("DEFAULT_RETENTION_DURATION"))
+		if err != nil || defaultRetentionDuration <= 0 {
+			log.Fatalf("invalid DEFAULT_RETENTION_DURATION %q", os.Getenv("DEFAULT_RETENTION_DURATION"))
+		}
+		if err := checkObjectLockEnabled(ctx, bucket); err != nil {
+			log.Fatal(err)
+		}
+		for _, route := range bucketRoutes {
+			if err := checkObjectLockEnabled(ctx, route.bucket); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 }
 
 func main() {
+	configure()
 	serveMux := http.NewServeMux()
-	serveMux.HandleFunc("/api/v1/file", fileHandler)
-	if err := http.ListenAndServe(":8081", serveMux); err != nil {
+	handle := func(pattern string, handler http.HandlerFunc) {
+		serveMux.HandleFunc(pattern, metricsMiddleware(pattern, limitClients(authenticate(handler))))
+	}
+	handler := fileHandler
+	if emitEMFMetrics {
+		handler = emfMiddleware(handler)
+	}
+	for pattern := range contentTypes {
+		handle(pattern, limitUploads(handler))
+	}
+	// Downloads sending a token are authorized by it instead of an API key.
+	serveMux.HandleFunc(downloadPath, metricsMiddleware(downloadPath, limitClients(acceptToken(downloadHandler))))
+	handle(filesPath, filesHandler)
+	handle(sessionsPath, sessionHandler)
+	handle(sessionsPath+"/", sessionHandler)
+	handle(chunksPath+"/", limitUploads(chunkHandler))
+	handle(uploadsPath, uploadsHandler)
+	handle(uploadsPath+"/", limitUploads(uploadsHandler))
+	handle(tusPath, tusHandler)
+	handle(tusPath+"/", limitUploads(tusHandler))
+	handle(notificationsPath+"/", notificationHandler)
+	handle(tokensPath, tokenHandler)
+	handle(stagedPath+"/", stagedHandler)
+	serveMux.Handle("/metrics", promhttp.Handler())
+	go sweepSessions(context.Background(), time.Minute, sessions, chunkedSessions, tusSessions, resumableSessions)
+	go sweepStaged(context.Background(), time.Minute)
+	if clientRate != nil {
+		go sweepClientLimits(context.Background(), time.Minute, clientRate)
+	}
+	if orphanedUploadTTL > 0 {
+		go sweepMultipartUploads(context.Background(), time.Hour, orphanedUploadTTL)
+	}
+	listener, err := net.Listen("tcp", ":8081")
+	if err != nil {
 		log.Fatal(err)
 	}
+	if maxConnections > 0 {
+		listener = limitListener(listener, maxConnections)
+	}
+	if err := serve(listener, logRequests(serveMux)); err != nil {
+		log.Fatal(err)
+	}
+	stores := []*sessionStore{sessions, chunkedSessions, tusSessions}
+	if _, ok := uploadStore.(*memoryUploadStore); ok {
+		stores = append(stores, resumableSessions)
+	}
+	abortStoredSessions(stores...)
 }
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	metadataHeaderPrefix = "X-Amz-Meta-"
+	// maxMetadataSize is the S3 limit of the user-defined metadata, measured as the sum of the
+	// bytes of every key and value.
+	maxMetadataSize = 2 << 10
+)
+
+// Metadata keys of the whole object hashes, stored when STORE_CONTENT_HASH is set.
+const (
+	contentMD5Metadata    = "content-md5"
+	contentSHA256Metadata = "content-sha256"
+)
+
+var (
+	defaultMetadata  map[string]string
+	storeContentHash bool
+)
+
+// parseMetadata parses "key=value" pairs. Keys are lowercased, as S3 stores them.
+func parseMetadata(s string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid metadata entry %q", pair)
+		}
+		metadata[strings.ToLower(key)] = value
+	}
+	if err := checkMetadata(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// requestMetadata merges the X-Amz-Meta-* headers over the default metadata.
+func requestMetadata(header http.Header) (map[string]string, error) {
+	metadata := make(map[string]string, len(defaultMetadata))
+	for key, value := range defaultMetadata {
+		metadata[key] = value
+	}
+	for name, values := range header {
+		if strings.HasPrefix(name, metadataHeaderPrefix) && len(name) > len(metadataHeaderPrefix) {
+			metadata[strings.ToLower(strings.TrimPrefix(name, metadataHeaderPrefix))] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	if err := checkMetadata(metadata); err != nil {
+		return nil, err
+	}
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
+// withContentHash returns a copy of the metadata with the base64 encoded MD5 and the hex encoded
+// SHA-256 of the whole object. Unlike the ETag of multipart uploads, they can be compared with
+// hashes computed by clients.
+func withContentHash(metadata map[string]string, md5, sha256 string) map[string]string {
+	withHash := make(map[string]string, len(metadata)+2)
+	for key, value := range metadata {
+		withHash[key] = value
+	}
+	withHash[contentMD5Metadata] = md5
+	withHash[contentSHA256Metadata] = sha256
+	return withHash
+}
+
+// checkMetadata checks the size of the metadata and that its values are printable US-ASCII, as
+// Amazon S3 returns them in headers. Clients encode other text, such as RFC 2047 encoded
+// filenames.
+func checkMetadata(metadata map[string]string) error {
+	for key, value := range metadata {
+		for i := 0; i < len(value); i++ {
+			if value[i] < ' ' || value[i] > '~' {
+				return fmt.Errorf("metadata %q is not printable US-ASCII", key)
+			}
+		}
+	}
+	return checkMetadataSize(metadata)
+}
+
+func checkMetadataSize(metadata map[string]string) error {
+	size := 0
+	for key, value := range metadata {
+		size += len(key) + len(value)
+	}
+	if size > maxMetadataSize {
+		return fmt.Errorf("metadata of %d bytes exceeds the %d bytes limit", size, maxMetadataSize)
+	}
+	return nil
+}
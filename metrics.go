@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The ratio between these two counters shows whether uploads are limited by the client's
+// upload speed (body reads dominate) or by Amazon S3 (part uploads dominate).
+var (
+	bodyReadSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upload_body_read_seconds_total",
+		Help: "Total time spent blocked reading request bodies.",
+	})
+	partUploadSeconds = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upload_part_upload_seconds_total",
+		Help: "Total time spent blocked on UploadPart calls.",
+	})
+	// Parts read from request bodies but waiting for an upload worker. A full queue means that
+	// Amazon S3 is slower than the clients and more workers would help.
+	partQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "upload_part_queue_length",
+		Help: "Number of parts waiting for an upload worker.",
+	})
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Requests answered, by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpRequestSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time spent answering requests, by route and method.",
+		Buckets: []float64{.01, .05, .1, .5, 1, 5, 10, 30, 60, 300, 900},
+	}, []string{"route", "method"})
+	httpRequestsInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Requests being answered, by route.",
+	}, []string{"route"})
+	uploadedBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "upload_bytes_total",
+		Help: "Bytes of the parts stored.",
+	})
+	partUploadAttemptSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "upload_part_attempt_duration_seconds",
+		Help:    "Time spent on each UploadPart attempt, by result.",
+		Buckets: prometheus.ExponentialBuckets(.05, 2, 12),
+	}, []string{"result"})
+	multipartOperations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "upload_multipart_operations_total",
+		Help: "Multipart uploads completed and aborted, by operation and result.",
+	}, []string{"operation", "result"})
+)
+
+// result labels the outcome of an operation.
+func result(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+// metricsMiddleware counts the requests of a route and their status codes.
+func metricsMiddleware(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		inFlight := httpRequestsInFlight.WithLabelValues(route)
+		inFlight.Inc()
+		defer inFlight.Dec()
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next(recorder, r)
+		httpRequestSeconds.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, r.Method, strconv.Itoa(recorder.statusCode)).Inc()
+	}
+}
+
+// meteredStorage measures the part uploads, completions and aborts of a Storage.
+type meteredStorage struct {
+	Storage
+}
+
+func (s meteredStorage) UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	start := time.Now()
+	output, err := s.Storage.UploadPart(ctx, input)
+	partUploadAttemptSeconds.WithLabelValues(result(err)).Observe(time.Since(start).Seconds())
+	if err == nil {
+		uploadedBytes.Add(float64(input.ContentLength))
+	}
+	return output, err
+}
+
+func (s meteredStorage) Complete(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	output, err := s.Storage.Complete(ctx, input)
+	multipartOperations.WithLabelValues("complete", result(err)).Inc()
+	return output, err
+}
+
+func (s meteredStorage) Abort(ctx context.Context, input *s3.AbortMultipartUploadInput) error {
+	err := s.Storage.Abort(ctx, input)
+	multipartOperations.WithLabelValues("abort", result(err)).Inc()
+	return err
+}
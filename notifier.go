@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/google/uuid"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const notificationsPath = "/api/v1/notifications"
+
+// Delivery states of a notification.
+const (
+	deliveryPending      = "pending"
+	deliveryDelivered    = "delivered"
+	deliveryDeadLettered = "dead_lettered"
+)
+
+// Notification is sent to the callback URL and the event targets once an upload is completed.
+type Notification struct {
+	ID          string            `json:"id"`
+	Bucket      string            `json:"bucket"`
+	Key         string            `json:"key"`
+	ContentType string            `json:"contentType"`
+	Size        int64             `json:"size"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Links       []Link            `json:"links"`
+	CreatedAt   time.Time         `json:"createdAt"`
+}
+
+// Publisher delivers the JSON body of a notification to a processing pipeline. Failures are
+// retried by the caller.
+type Publisher interface {
+	Publish(ctx context.Context, body []byte) error
+}
+
+// webhookPublisher posts the notifications to a callback URL.
+type webhookPublisher struct {
+	url string
+}
+
+func (p webhookPublisher) Publish(ctx context.Context, body []byte) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := deliveryHTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("callback responded %s", response.Status)
+	}
+	return nil
+}
+
+// sqsPublisher sends the notifications as messages of an Amazon SQS queue.
+type sqsPublisher struct {
+	client   *sqs.Client
+	queueURL string
+}
+
+func (p sqsPublisher) Publish(ctx context.Context, body []byte) error {
+	_, err := p.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(p.queueURL),
+		MessageBody: aws.String(string(body)),
+	})
+	return err
+}
+
+// snsPublisher publishes the notifications to an Amazon SNS topic.
+type snsPublisher struct {
+	client   *sns.Client
+	topicARN string
+}
+
+func (p snsPublisher) Publish(ctx context.Context, body []byte) error {
+	_, err := p.client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(p.topicARN),
+		Message:  aws.String(string(body)),
+	})
+	return err
+}
+
+type DeliveryStatus struct {
+	ID        string `json:"id"`
+	State     string `json:"state"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"lastError,omitempty"`
+	updatedAt time.Time
+}
+
+var (
+	webhookURL          string      // Delivered to when the request has no X-Callback-URL.
+	eventPublishers     []Publisher // EVENT_SQS_QUEUE_URL and EVENT_SNS_TOPIC_ARN, notified of every upload.
+	callbackURLPrefixes []*url.URL  // Allowed X-Callback-URL prefixes.
+	deadLetterLocation  string      // "file:<path>" or "s3://<bucket>/<prefix>".
+	maxDeliveryAttempts = 5
+	deliveryBackoff     = time.Second
+	deliveryHTTPClient  = &http.Client{Timeout: 10 * time.Second}
+	deliveryStatusTTL   = time.Hour // Finished deliveries are forgotten after it.
+	deliveries          = &deliveryStore{statuses: make(map[string]*DeliveryStatus)}
+	deadLetterFileMu    sync.Mutex
+)
+
+type deliveryStore struct {
+	mu       sync.Mutex
+	statuses map[string]*DeliveryStatus
+}
+
+func (s *deliveryStore) update(id string, update func(status *DeliveryStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[id]
+	if !ok {
+		status = &DeliveryStatus{ID: id, State: deliveryPending}
+		s.statuses[id] = status
+	}
+	update(status)
+	status.updatedAt = time.Now()
+	for id, status := range s.statuses {
+		if status.State != deliveryPending && time.Since(status.updatedAt) > deliveryStatusTTL {
+			delete(s.statuses, id)
+		}
+	}
+}
+
+func (s *deliveryStore) get(id string) (DeliveryStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, ok := s.statuses[id]
+	if !ok {
+		return DeliveryStatus{}, false
+	}
+	return *status, true
+}
+
+// callbackURL returns the URL the upload's notification is delivered to, if any.
+func callbackURL(r *http.Request) (string, error) {
+	callback := r.Header.Get("X-Callback-URL")
+	if callback == "" {
+		return webhookURL, nil
+	}
+	u, err := parseCallbackURL(callback)
+	if err != nil {
+		return "", err
+	}
+	for _, prefix := range callbackURLPrefixes {
+		if matchesCallbackPrefix(u, prefix) {
+			return u.String(), nil
+		}
+	}
+	return "", fmt.Errorf("callback URL %q is not allowed", callback)
+}
+
+// parseCallbackURL parses an absolute http or https URL without credentials or dot segments,
+// which could otherwise make a URL look like it is under an allowed prefix.
+func parseCallbackURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback URL %q", raw)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return nil, fmt.Errorf("callback URL %q must be an http or https URL without credentials", raw)
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return nil, fmt.Errorf("callback URL %q has dot segments", raw)
+		}
+	}
+	return u, nil
+}
+
+// matchesCallbackPrefix reports whether u has the scheme and host of prefix and a path under
+// its path. A prefix path that does not end with a slash matches itself and the paths below it,
+// not the paths that merely start with the same characters.
+func matchesCallbackPrefix(u, prefix *url.URL) bool {
+	if u.Scheme != prefix.Scheme || !strings.EqualFold(u.Host, prefix.Host) {
+		return false
+	}
+	if prefix.Path == "" || strings.HasSuffix(prefix.Path, "/") {
+		return strings.HasPrefix(u.Path, prefix.Path) || u.Path+"/" == prefix.Path
+	}
+	return u.Path == prefix.Path || strings.HasPrefix(u.Path, prefix.Path+"/")
+}
+
+// notifyUploaded notifies the callback URL, if any, and every event publisher of a completed
+// upload, and returns the links to the status of each delivery.
+func notifyUploaded(callback string, notification Notification) []Link {
+	var links []Link
+	if callback != "" {
+		links = append(links, notify(webhookPublisher{url: callback}, notification))
+	}
+	for _, publisher := range eventPublishers {
+		links = append(links, notify(publisher, notification))
+	}
+	return links
+}
+
+// notify delivers the notification in the background and returns the link to its status.
+func notify(publisher Publisher, notification Notification) Link {
+	notification.ID = uuid.New().String()
+	notification.CreatedAt = time.Now()
+	deliveries.update(notification.ID, func(*DeliveryStatus) {})
+	go deliver(publisher, notification)
+	return Link{
+		Rel: "notification",
+		URL: notificationsPath + "/" + notification.ID,
+	}
+}
+
+// deliver publishes the notification, retrying failures with exponential backoff and jitter,
+// and writes it to the dead-letter location once every attempt failed.
+func deliver(publisher Publisher, notification Notification) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	backoff := deliveryBackoff
+	for attempt := 1; attempt <= maxDeliveryAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), deliveryHTTPClient.Timeout)
+		err = publisher.Publish(ctx, body)
+		cancel()
+		deliveries.update(notification.ID, func(status *DeliveryStatus) {
+			status.Attempts = attempt
+			if err == nil {
+				status.State = deliveryDelivered
+				status.LastError = ""
+			} else {
+				status.LastError = err.Error()
+			}
+		})
+		if err == nil {
+			return
+		}
+		if attempt < maxDeliveryAttempts {
+			time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+			backoff *= 2
+		}
+	}
+	log.Printf("notification %s undelivered after %d attempts: %v", notification.ID, maxDeliveryAttempts, err)
+	if err := deadLetter(notification.ID, body); err != nil {
+		log.Print(err)
+		return
+	}
+	deliveries.update(notification.ID, func(status *DeliveryStatus) {
+		status.State = deliveryDeadLettered
+	})
+}
+
+// deadLetter stores an undelivered notification at the dead-letter location.
+func deadLetter(id string, body []byte) error {
+	switch {
+	case strings.HasPrefix(deadLetterLocation, "file:"):
+		deadLetterFileMu.Lock()
+		defer deadLetterFileMu.Unlock()
+		file, err := os.OpenFile(strings.TrimPrefix(deadLetterLocation, "file:"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(append(body, '\n')); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	case strings.HasPrefix(deadLetterLocation, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(deadLetterLocation, "s3://"), "/")
+		_, err := client.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(path.Join(prefix, id+".json")),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+		return err
+	default:
+		return fmt.Errorf("no dead-letter location for notification %s", id)
+	}
+}
+
+// notificationHandler serves GET /api/v1/notifications/{id} with the delivery status.
+func notificationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	status, ok := deliveries.get(strings.TrimPrefix(r.URL.Path, notificationsPath+"/"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no such notification")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default retention applied to every upload unless the request sets its own through the
+// X-Amz-Object-Lock-Mode and X-Amz-Object-Lock-Retain-Until-Date headers.
+var (
+	defaultObjectLockMode    types.ObjectLockMode
+	defaultRetentionDuration time.Duration
+)
+
+// objectLock is the retention of an uploaded object. The zero value means no retention.
+type objectLock struct {
+	mode        types.ObjectLockMode
+	retainUntil *time.Time
+}
+
+// parseObjectLockMode validates an object lock mode, ignoring its case.
+func parseObjectLockMode(s string) (types.ObjectLockMode, error) {
+	mode := types.ObjectLockMode(strings.ToUpper(s))
+	switch mode {
+	case types.ObjectLockModeGovernance, types.ObjectLockModeCompliance:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid object lock mode %q", s)
+	}
+}
+
+// parseRetentionDuration parses a time.Duration, also accepting a number of days such as "30d".
+func parseRetentionDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid retention duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// requestObjectLock returns the retention requested by the headers, or the default one.
+func requestObjectLock(r *http.Request) (objectLock, error) {
+	modeHeader := r.Header.Get("X-Amz-Object-Lock-Mode")
+	retainUntilHeader := r.Header.Get("X-Amz-Object-Lock-Retain-Until-Date")
+	if modeHeader == "" && retainUntilHeader == "" {
+		if defaultObjectLockMode == "" {
+			return objectLock{}, nil
+		}
+		retainUntil := time.Now().Add(defaultRetentionDuration)
+		return objectLock{mode: defaultObjectLockMode, retainUntil: &retainUntil}, nil
+	}
+	mode, err := parseObjectLockMode(modeHeader)
+	if err != nil {
+		return objectLock{}, err
+	}
+	retainUntil, err := time.Parse(time.RFC3339, retainUntilHeader)
+	if err != nil {
+		return objectLock{}, fmt.Errorf("invalid retain until date %q", retainUntilHeader)
+	}
+	if !retainUntil.After(time.Now()) {
+		return objectLock{}, fmt.Errorf("retain until date %q is not in the future", retainUntilHeader)
+	}
+	return objectLock{mode: mode, retainUntil: &retainUntil}, nil
+}
+
+// checkObjectLockEnabled fails when the bucket does not have object lock enabled.
+func checkObjectLockEnabled(ctx context.Context, bucket string) error {
+	output, err := client.GetObjectLockConfiguration(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return fmt.Errorf("object lock configuration of bucket %q: %w", bucket, err)
+	}
+	if output.ObjectLockConfiguration == nil || output.ObjectLockConfiguration.ObjectLockEnabled != types.ObjectLockEnabledEnabled {
+		return fmt.Errorf("bucket %q does not have object lock enabled", bucket)
+	}
+	return nil
+}
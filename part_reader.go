@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Part buffering strategies selectable through PART_READER.
+const (
+	partReaderMemory = "memory" // Each part is buffered in memory.
+	partReaderDisk   = "disk"   // Each part is buffered in a temporary file.
+	partReaderRanged = "ranged" // The whole body is spooled to a temporary file and parts are ranges of it.
+)
+
+// Part is a piece of the request body to be stored with UploadPart.
+type Part struct {
+	Number  int32 // The first part number must always start with 1.
+	Body    io.ReadSeeker
+	Size    int64
+	Last    bool
+	release func()
+}
+
+// Release frees the buffer of the part once it is uploaded.
+func (p Part) Release() {
+	if p.release != nil {
+		p.release()
+	}
+}
+
+// PartReader yields successive parts of a body. Each part has its own buffer, so several parts
+// can be uploaded concurrently; a part's Body is valid until the part is released or the reader
+// closed.
+type PartReader interface {
+	NextPart() (Part, error)
+	Close() error
+}
+
+// newPartReader returns a PartReader splitting body into parts of partSize bytes
+// using the given strategy.
+func newPartReader(strategy string, body io.Reader, partSize int64) (PartReader, error) {
+	switch strategy {
+	case partReaderMemory:
+		return &memoryPartReader{lookahead: lookahead{body: bufio.NewReader(body)}, partSize: partSize}, nil
+	case partReaderDisk:
+		return &diskPartReader{lookahead: lookahead{body: bufio.NewReader(body)}, partSize: partSize}, nil
+	case partReaderRanged:
+		file, err := os.CreateTemp("", "body-*")
+		if err != nil {
+			return nil, err
+		}
+		size, err := io.Copy(file, body)
+		if err != nil {
+			closeTemp(file)
+			return nil, err
+		}
+		return &rangedPartReader{source: file, closer: func() error { return closeTemp(file) }, size: size, partSize: partSize}, nil
+	default:
+		return nil, fmt.Errorf("unknown part reader %q", strategy)
+	}
+}
+
+// lookahead is the body of the memory and disk part readers, which peek a byte past every full
+// part, so that a body whose size is a multiple of the part size ends with its last full part
+// instead of an empty one.
+type lookahead struct {
+	body *bufio.Reader
+	err  error // Failure of the last peek, returned instead of the next part.
+}
+
+// atEOF reports whether the body has no byte left after a full part. A failing peek does not
+// fail the part, which was read whole, but the next one.
+func (l *lookahead) atEOF() bool {
+	_, err := l.body.Peek(1)
+	if err != nil && err != io.EOF {
+		l.err = err
+	}
+	return err == io.EOF
+}
+
+// memoryPartReader buffers each part in a pooled buffer, returned to the pool when the part is
+// released.
+type memoryPartReader struct {
+	lookahead
+	partSize   int64
+	partNumber int32
+}
+
+func (r *memoryPartReader) NextPart() (Part, error) {
+	if r.err != nil {
+		return Part{}, r.err
+	}
+	buffer := getBuffer(r.partSize)
+	n, err := io.ReadFull(r.body, buffer[:r.partSize])
+	// The io.EOF and io.ErrUnexpectedEOF errors occur when the stream has reached its end.
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		putBuffer(buffer)
+		return Part{}, err
+	}
+	r.partNumber++
+	return Part{
+		Number:  r.partNumber,
+		Body:    bytes.NewReader(buffer[:n]),
+		Size:    int64(n),
+		Last:    err != nil || r.atEOF(),
+		release: func() { putBuffer(buffer) },
+	}, nil
+}
+
+func (r *memoryPartReader) Close() error {
+	return nil
+}
+
+// diskPartReader buffers each part in a temporary file, removed when the part is released.
+type diskPartReader struct {
+	lookahead
+	partSize   int64
+	partNumber int32
+}
+
+func (r *diskPartReader) NextPart() (Part, error) {
+	if r.err != nil {
+		return Part{}, r.err
+	}
+	file, err := os.CreateTemp("", "part-*")
+	if err != nil {
+		return Part{}, err
+	}
+	n, err := io.CopyN(file, r.body, r.partSize)
+	if err != nil && err != io.EOF {
+		closeTemp(file)
+		return Part{}, err
+	}
+	r.partNumber++
+	return Part{
+		Number:  r.partNumber,
+		Body:    io.NewSectionReader(file, 0, n),
+		Size:    n,
+		Last:    err == io.EOF || r.atEOF(),
+		release: func() { closeTemp(file) },
+	}, nil
+}
+
+func (r *diskPartReader) Close() error {
+	return nil
+}
+
+// rangedPartReader reads parts as ranges of a seekable source, so every part's Body
+// remains valid until the reader is closed.
+type rangedPartReader struct {
+	source     io.ReaderAt
+	closer     func() error
+	size       int64
+	partSize   int64
+	offset     int64
+	partNumber int32
+}
+
+func (r *rangedPartReader) NextPart() (Part, error) {
+	n := r.size - r.offset
+	if n > r.partSize {
+		n = r.partSize
+	}
+	part := Part{
+		Number: r.partNumber + 1,
+		Body:   io.NewSectionReader(r.source, r.offset, n),
+		Size:   n,
+		Last:   r.offset+n == r.size,
+	}
+	r.offset += n
+	r.partNumber++
+	return part, nil
+}
+
+func (r *rangedPartReader) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+	return r.closer()
+}
+
+// closeTemp closes and removes a temporary file.
+func closeTemp(file *os.File) error {
+	err := file.Close()
+	if removeErr := os.Remove(file.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// readParts reads every part of body split by the strategy, and returns their sizes.
+func readParts(t *testing.T, strategy string, body io.Reader, partSize int64) []int64 {
+	t.Helper()
+	partReader, err := newPartReader(strategy, body, partSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partReader.Close()
+	var sizes []int64
+	for {
+		part, err := partReader.NextPart()
+		if err != nil {
+			t.Fatalf("%s: part %d: %v", strategy, len(sizes)+1, err)
+		}
+		read, err := io.Copy(io.Discard, part.Body)
+		part.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if read != part.Size {
+			t.Fatalf("%s: part %d holds %d bytes, want its size %d", strategy, part.Number, read, part.Size)
+		}
+		sizes = append(sizes, part.Size)
+		if part.Last {
+			return sizes
+		}
+	}
+}
+
+func TestPartReaderSizes(t *testing.T) {
+	const partSize = 10
+	tests := []struct {
+		size int
+		want []int64
+	}{
+		{size: 0, want: []int64{0}},
+		{size: 1, want: []int64{1}},
+		{size: partSize - 1, want: []int64{partSize - 1}},
+		{size: partSize, want: []int64{partSize}},
+		{size: partSize + 1, want: []int64{partSize, 1}},
+		{size: 3 * partSize, want: []int64{partSize, partSize, partSize}},
+	}
+	for _, strategy := range []string{partReaderMemory, partReaderDisk, partReaderRanged} {
+		for _, test := range tests {
+			got := readParts(t, strategy, strings.NewReader(strings.Repeat("x", test.size)), partSize)
+			if !equalSizes(got, test.want) {
+				t.Errorf("%s: %d bytes were split into %v, want %v", strategy, test.size, got, test.want)
+			}
+			if n := expectedParts(int64(test.size), partSize); test.size > 0 && n != len(test.want) {
+				t.Errorf("expectedParts(%d) = %d, want %d", test.size, n, len(test.want))
+			}
+		}
+	}
+}
+
+func TestPartReaderTrickling(t *testing.T) {
+	const partSize = 1000
+	body := strings.Repeat("x", 3*partSize+partSize/2)
+	for _, strategy := range []string{partReaderMemory, partReaderDisk} {
+		for _, trickle := range []func(io.Reader) io.Reader{iotest.OneByteReader, iotest.HalfReader} {
+			sizes := readParts(t, strategy, trickle(strings.NewReader(body)), partSize)
+			if !equalSizes(sizes, []int64{partSize, partSize, partSize, partSize / 2}) {
+				t.Errorf("%s: a trickling body was split into %v", strategy, sizes)
+			}
+		}
+	}
+}
+
+func TestPartReaderPeekFailure(t *testing.T) {
+	failure := errors.New("connection reset")
+	for _, strategy := range []string{partReaderMemory, partReaderDisk} {
+		partReader, err := newPartReader(strategy, io.MultiReader(strings.NewReader("0123456789"), &failingReader{err: failure}), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part, err := partReader.NextPart()
+		if err != nil || part.Size != 10 || part.Last {
+			t.Errorf("%s: got part of %d bytes, last %t and err %v, want the full part", strategy, part.Size, part.Last, err)
+		}
+		part.Release()
+		if _, err := partReader.NextPart(); !errors.Is(err, failure) {
+			t.Errorf("%s: got err %v for the next part, want %v", strategy, err, failure)
+		}
+		partReader.Close()
+	}
+}
+
+func TestUploadPartsMaxParts(t *testing.T) {
+	defer func(s Storage) { storage = s }(storage)
+	storage = delayedStorage{delay: func(int32) time.Duration { return 0 }}
+	tests := []struct {
+		size    int
+		wantErr error
+	}{
+		{size: maxPartNumber},
+		{size: maxPartNumber + 1, wantErr: errTooManyParts},
+	}
+	for _, test := range tests {
+		partReader, err := newPartReader(partReaderMemory, strings.NewReader(strings.Repeat("x", test.size)), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		completedParts, _, err := uploadParts(context.Background(), partReader, testUpload, encryption{}, expectedParts(int64(test.size), 1), nil)
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%d bytes in parts of 1 byte: got err %v, want %v", test.size, err, test.wantErr)
+		}
+		if test.wantErr == nil && len(completedParts) != maxPartNumber {
+			t.Errorf("%d bytes in parts of 1 byte: got %d parts, want %d", test.size, len(completedParts), maxPartNumber)
+		}
+	}
+}
+
+// failingReader fails every read with err.
+type failingReader struct {
+	err error
+}
+
+func (r *failingReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func equalSizes(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"sort"
+	"strings"
+)
+
+// expectedParts returns how many parts a body of contentLength bytes is split into, to pre-size
+// the completed parts. Unknown lengths return zero.
+func expectedParts(contentLength, partSize int64) int {
+	if contentLength <= 0 {
+		return 0
+	}
+	n := (contentLength + partSize - 1) / partSize
+	if n > maxPartNumber {
+		n = maxPartNumber
+	}
+	return int(n)
+}
+
+// partSizeFor returns the size of the parts a body of contentLength bytes is split into:
+// partSize, or the smallest multiple of 1 MB keeping bodies too large for partSize within
+// maxPartNumber parts. Unknown lengths use partSize.
+func partSizeFor(contentLength, partSize int64) int64 {
+	if contentLength <= partSize*maxPartNumber {
+		return partSize
+	}
+	const step = 1024 * 1024
+	size := (contentLength + maxPartNumber - 1) / maxPartNumber
+	return (size + step - 1) / step * step
+}
+
+// sortCompletedParts sorts the parts in ascending part number order, as Amazon S3 requires for
+// CompleteMultipartUpload, and fails if a part number is repeated or out of range.
+func sortCompletedParts(parts []types.CompletedPart) error {
+	if !sort.SliceIsSorted(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber }) {
+		sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	}
+	for i, part := range parts {
+		if part.PartNumber < 1 || part.PartNumber > maxPartNumber {
+			return fmt.Errorf("part number %d out of range", part.PartNumber)
+		}
+		if i > 0 && part.PartNumber == parts[i-1].PartNumber {
+			return fmt.Errorf("part number %d repeated", part.PartNumber)
+		}
+	}
+	return nil
+}
+
+// PartSizeMessage lists the parts smaller than the minimum size Amazon S3 requires of every part
+// but the last.
+type PartSizeMessage struct {
+	MinPartSize     int64         `json:"minPartSize"`
+	UndersizedParts []SessionPart `json:"undersizedParts"`
+}
+
+// undersizedParts returns the parts, in ascending part number order, that are smaller than the
+// minimum part size without being the last one.
+func undersizedParts(parts []types.Part) []SessionPart {
+	var undersized []SessionPart
+	for i, part := range parts {
+		if i < len(parts)-1 && part.Size < minUploadPartSize {
+			undersized = append(undersized, SessionPart{
+				PartNumber: part.PartNumber,
+				Size:       part.Size,
+			})
+		}
+	}
+	return undersized
+}
+
+// entityTooSmall reports whether CompleteMultipartUpload failed because a part other than the last
+// one was smaller than the minimum part size.
+func entityTooSmall(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == "EntityTooSmall"
+}
+
+// MissingPartsMessage lists the part numbers a multipart upload cannot be completed without.
+type MissingPartsMessage struct {
+	MissingParts []int32 `json:"missingParts"`
+}
+
+// missingParts returns the part numbers missing from the sorted parts for them to form the
+// sequence from 1 to n, or to their highest part number when n is zero.
+func missingParts(parts []types.CompletedPart, n int32) []int32 {
+	if n == 0 && len(parts) > 0 {
+		n = parts[len(parts)-1].PartNumber
+	}
+	var missing []int32
+	next := int32(1)
+	for _, part := range parts {
+		for ; next < part.PartNumber && next <= n; next++ {
+			missing = append(missing, next)
+		}
+		next = part.PartNumber + 1
+	}
+	for ; next <= n; next++ {
+		missing = append(missing, next)
+	}
+	return missing
+}
+
+// selectParts returns the uploaded parts that were requested, in ascending part number order,
+// and fails if a requested part was not uploaded with the requested ETag.
+func selectParts(uploaded []types.Part, requested []SessionPart) ([]types.Part, error) {
+	etags := make(map[int32]string, len(requested))
+	for _, part := range requested {
+		etags[part.PartNumber] = strings.Trim(part.ETag, `"`)
+	}
+	selected := make([]types.Part, 0, len(requested))
+	for _, part := range uploaded {
+		etag, ok := etags[part.PartNumber]
+		if !ok {
+			continue
+		}
+		if etag != strings.Trim(aws.ToString(part.ETag), `"`) {
+			return nil, fmt.Errorf("part %d was uploaded with ETag %s", part.PartNumber, aws.ToString(part.ETag))
+		}
+		delete(etags, part.PartNumber)
+		selected = append(selected, part)
+	}
+	if len(etags) > 0 {
+		notUploaded := make([]int32, 0, len(etags))
+		for partNumber := range etags {
+			notUploaded = append(notUploaded, partNumber)
+		}
+		sort.Slice(notUploaded, func(i, j int) bool { return notUploaded[i] < notUploaded[j] })
+		return nil, fmt.Errorf("parts %v were not uploaded", notUploaded)
+	}
+	return selected, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSortCompletedPartsMaxParts(t *testing.T) {
+	parts := make([]types.CompletedPart, 0, expectedParts(maxPartNumber*minUploadPartSize-1, minUploadPartSize))
+	if cap(parts) != maxPartNumber {
+		t.Fatalf("expected %d parts, want %d", cap(parts), maxPartNumber)
+	}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(maxPartNumber) {
+		parts = append(parts, types.CompletedPart{PartNumber: int32(i + 1)})
+	}
+	if err := sortCompletedParts(parts); err != nil {
+		t.Fatal(err)
+	}
+	for i, part := range parts {
+		if part.PartNumber != int32(i+1) {
+			t.Fatalf("part %d has number %d", i, part.PartNumber)
+		}
+	}
+	if missing := missingParts(parts, maxPartNumber); len(missing) != 0 {
+		t.Errorf("got missing parts %v", missing)
+	}
+}
+
+func TestSortCompletedPartsInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []int32
+	}{
+		{name: "repeated", parts: []int32{2, 1, 2}},
+		{name: "zero", parts: []int32{0, 1}},
+		{name: "above the maximum", parts: []int32{1, maxPartNumber + 1}},
+	}
+	for _, test := range tests {
+		parts := make([]types.CompletedPart, len(test.parts))
+		for i, partNumber := range test.parts {
+			parts[i].PartNumber = partNumber
+		}
+		if err := sortCompletedParts(parts); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestMissingParts(t *testing.T) {
+	tests := []struct {
+		name  string
+		parts []int32
+		n     int32
+		want  []int32
+	}{
+		{name: "contiguous", parts: []int32{1, 2, 3}, want: nil},
+		{name: "missing middle part", parts: []int32{1, 2, 4, 5}, want: []int32{3}},
+		{name: "missing first part", parts: []int32{2, 3}, want: []int32{1}},
+		{name: "missing several parts", parts: []int32{1, 4, 6}, want: []int32{2, 3, 5}},
+		{name: "missing last parts", parts: []int32{1, 2}, n: 4, want: []int32{3, 4}},
+		{name: "no parts", n: 2, want: []int32{1, 2}},
+	}
+	for _, test := range tests {
+		parts := make([]types.CompletedPart, len(test.parts))
+		for i, partNumber := range test.parts {
+			parts[i].PartNumber = partNumber
+		}
+		if got := missingParts(parts, test.n); !equalPartNumbers(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func equalPartNumbers(a, b []int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUndersizedParts(t *testing.T) {
+	parts := []types.Part{
+		{PartNumber: 1, Size: minUploadPartSize},
+		{PartNumber: 2, Size: minUploadPartSize - 1},
+		{PartNumber: 3, Size: minUploadPartSize},
+		{PartNumber: 4, Size: 1},
+	}
+	undersized := undersizedParts(parts)
+	if len(undersized) != 1 || undersized[0].PartNumber != 2 || undersized[0].Size != minUploadPartSize-1 {
+		t.Fatalf("got undersized parts %+v, want part 2", undersized)
+	}
+
+	w := httptest.NewRecorder()
+	writePartSizes(w, httptest.NewRequest(http.MethodPost, "/", nil), session{ID: "id"}, undersized)
+	var message PartSizeMessage
+	if err := json.NewDecoder(w.Body).Decode(&message); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || message.MinPartSize != minUploadPartSize || len(message.UndersizedParts) != 1 {
+		t.Errorf("got %d %+v", w.Code, message)
+	}
+}
+
+func TestEntityTooSmall(t *testing.T) {
+	err := fmt.Errorf("completing: %w", &smithy.GenericAPIError{Code: "EntityTooSmall"})
+	if !entityTooSmall(err) {
+		t.Errorf("entityTooSmall(%v) = false", err)
+	}
+	if err := (&smithy.GenericAPIError{Code: "InvalidPart"}); entityTooSmall(err) {
+		t.Errorf("entityTooSmall(%v) = true", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"net/http"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	requirePoster bool   // Rejects the videos no poster can be extracted from.
+	ffmpegPath    string // Empty disables the poster extraction.
+)
+
+var errNoPoster = errors.New("no poster")
+
+// posterSuffix replaces the extension of a video key in the key of its poster.
+const posterSuffix = "-poster.jpg"
+
+// posterKey returns the key of the poster of the video stored under key.
+func posterKey(key string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + posterSuffix
+}
+
+// wantsPoster reports whether a poster is extracted from the upload.
+func wantsPoster(contentType string, encryption encryption) bool {
+	return strings.HasPrefix(contentType, "video/") && canExtractPoster(encryption)
+}
+
+// canExtractPoster reports whether a poster can be extracted from a video with the encryption.
+// ffmpeg reads the video through a presigned URL, which cannot carry a customer key.
+func canExtractPoster(encryption encryption) bool {
+	return ffmpegPath != "" && encryption.customerKey == nil
+}
+
+// rejectsVideo reports whether a video upload is rejected up front, as it could not get a poster.
+func rejectsVideo(contentType string, encryption encryption) bool {
+	return requirePoster && strings.HasPrefix(contentType, "video/") && !canExtractPoster(encryption)
+}
+
+// extractPoster stores the first keyframe of the video stored under key as a JPEG under its
+// poster key, with the same encryption, and returns the poster's location, derived from the
+// video's. ffmpeg reads the video through a presigned URL, fetching only the ranges it needs.
+func extractPoster(ctx context.Context, bucket, key, location string, encryption encryption) (string, error) {
+	presignClient := s3.NewPresignClient(client, s3.WithPresignExpires(15*time.Minute))
+	presignedRequest, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-v", "error",
+		"-skip_frame", "nokey",
+		"-i", presignedRequest.URL,
+		"-frames:v", "1",
+		"-f", "image2",
+		"-c:v", "mjpeg",
+		"pipe:1",
+	)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%w: %v: %s", errNoPoster, err, strings.TrimSpace(stderr.String()))
+	}
+	if stdout.Len() == 0 {
+		return "", fmt.Errorf("%w: no keyframe in %s", errNoPoster, key)
+	}
+	return putPoster(ctx, bucket, key, location, stdout.Bytes(), encryption)
+}
+
+// putPoster stores the JPEG poster of the video stored under key and returns its location.
+func putPoster(ctx context.Context, bucket, key, location string, poster []byte, encryption encryption) (string, error) {
+	if _, err := client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:                  aws.String(bucket),
+		Key:                     aws.String(posterKey(key)),
+		Body:                    bytes.NewReader(poster),
+		ContentType:             aws.String("image/jpeg"),
+		SSEKMSKeyId:             encryption.kmsKeyID,
+		SSEKMSEncryptionContext: encryption.kmsContext,
+		ServerSideEncryption:    encryption.serverSideEncryption,
+		SSECustomerAlgorithm:    encryption.customerAlgorithm,
+		SSECustomerKey:          encryption.customerKey,
+		SSECustomerKeyMD5:       encryption.customerKeyMD5,
+	}); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(location, key) + posterKey(key), nil
+}
+
+// attachPoster extracts the poster of a completed upload, if it is a video, and returns its link,
+// nil when it has none. The error is only returned when the video requires a poster, in which
+// case the video is deleted; otherwise it is logged and the video kept without a poster.
+func attachPoster(ctx context.Context, bucket, key, location, contentType string, encryption encryption) (*Link, error) {
+	if !wantsPoster(contentType, encryption) {
+		return nil, nil
+	}
+	posterLocation, err := extractPoster(ctx, bucket, key, location, encryption)
+	if err != nil && !requirePoster {
+		logEntry(ctx, logLevelError, "extracting poster failed", "error", err)
+		return nil, nil
+	} else if err != nil {
+		if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			logEntry(ctx, logLevelError, "deleting video failed", "error", err)
+		}
+		return nil, err
+	}
+	return &Link{
+		Rel: "poster",
+		URL: objectURL(ctx, bucket, posterKey(key), posterLocation),
+	}, nil
+}
+
+// storePoster stores the poster sent along with a video upload and returns its link. The video
+// is deleted when the poster cannot be stored, as it was required.
+func storePoster(ctx context.Context, bucket, key, location string, poster []byte, encryption encryption) (*Link, error) {
+	posterLocation, err := putPoster(ctx, bucket, key, location, poster, encryption)
+	if err != nil {
+		if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		}); err != nil {
+			logEntry(ctx, logLevelError, "deleting video failed", "error", err)
+		}
+		return nil, err
+	}
+	return &Link{
+		Rel: "poster",
+		URL: objectURL(ctx, bucket, posterKey(key), posterLocation),
+	}, nil
+}
+
+// writePosterError answers an upload whose video required a poster that could not be stored.
+func writePosterError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errNoPoster) {
+		logEntry(r.Context(), logLevelError, "poster unavailable", "error", err)
+		writeError(w, http.StatusUnprocessableEntity, "poster_unavailable", err.Error())
+		return
+	}
+	writeS3Error(w, r, err)
+}
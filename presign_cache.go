@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log"
+	"sync"
+	"time"
+)
+
+// minPresignedValidity is the shortest validity a cached presigned URL is still handed out with.
+const minPresignedValidity = 10 * time.Second
+
+var (
+	presignExpiry      = 15 * time.Minute // Validity of the presigned download URLs.
+	presignCacheWindow time.Duration      // Zero disables the cache.
+	presignCacheSize   = 1000
+	presignLinks       = true // Whether completed uploads link presigned URLs instead of their location.
+	presignedURLs      = &presignCache{lru: list.New(), entries: make(map[presignCacheKey]*list.Element)}
+)
+
+type presignCacheKey struct {
+	operation string
+	bucket    string
+	key       string
+	window    int64 // Expiry divided by the cache window.
+}
+
+type presignCacheEntry struct {
+	cacheKey  presignCacheKey
+	url       string
+	expiresAt time.Time
+}
+
+// presignCache keeps the presigned URLs of recently requested objects, evicting the least
+// recently used ones beyond presignCacheSize.
+type presignCache struct {
+	mu      sync.Mutex
+	lru     *list.List // Most recently used first.
+	entries map[presignCacheKey]*list.Element
+}
+
+func (c *presignCache) get(cacheKey presignCacheKey) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[cacheKey]
+	if !ok {
+		return "", false
+	}
+	entry := element.Value.(*presignCacheEntry)
+	if time.Until(entry.expiresAt) < minPresignedValidity {
+		c.lru.Remove(element)
+		delete(c.entries, cacheKey)
+		return "", false
+	}
+	c.lru.MoveToFront(element)
+	return entry.url, true
+}
+
+func (c *presignCache) put(entry *presignCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.cacheKey]; ok {
+		c.lru.Remove(element)
+	}
+	c.entries[entry.cacheKey] = c.lru.PushFront(entry)
+	for c.lru.Len() > presignCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*presignCacheEntry).cacheKey)
+	}
+}
+
+// invalidate removes every presigned URL of the object.
+func (c *presignCache) invalidate(bucket, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for cacheKey, element := range c.entries {
+		if cacheKey.bucket == bucket && cacheKey.key == key {
+			c.lru.Remove(element)
+			delete(c.entries, cacheKey)
+		}
+	}
+}
+
+// presignGetObject returns a presigned GetObject URL of the object expiring no later than
+// expiresAt. With the cache enabled, the URL expires at the start of the cache window expiresAt
+// falls in, so that it is shared by every request whose expiry falls in the same window.
+func presignGetObject(ctx context.Context, bucket, key string, expiresAt time.Time) (string, error) {
+	cacheKey := presignCacheKey{operation: "GetObject", bucket: bucket, key: key}
+	cached := false
+	if presignCacheWindow > 0 {
+		if windowStart := expiresAt.Truncate(presignCacheWindow); time.Until(windowStart) >= minPresignedValidity {
+			cacheKey.window = windowStart.UnixNano() / int64(presignCacheWindow)
+			if url, ok := presignedURLs.get(cacheKey); ok {
+				return url, nil
+			}
+			expiresAt = windowStart
+			cached = true
+		}
+	}
+	presignClient := s3.NewPresignClient(client, s3.WithPresignExpires(time.Until(expiresAt)))
+	presignedRequest, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", err
+	}
+	if cached {
+		presignedURLs.put(&presignCacheEntry{cacheKey: cacheKey, url: presignedRequest.URL, expiresAt: expiresAt})
+	}
+	return presignedRequest.URL, nil
+}
+
+// objectURL returns the URL linking a completed upload: a presigned GetObject URL valid for
+// presignExpiry, as the location of objects in private buckets cannot be fetched, or location
+// when presignLinks is disabled or presigning fails.
+func objectURL(ctx context.Context, bucket, key, location string) string {
+	if !presignLinks {
+		return location
+	}
+	url, err := presignGetObject(ctx, bucket, key, time.Now().Add(presignExpiry))
+	if err != nil {
+		log.Print(err)
+		return location
+	}
+	return url
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressRetention is the time the progress of a finished upload stays available, so that
+// clients polling it see its last state.
+const progressRetention = 5 * time.Minute
+
+// Upload states of Progress.
+const (
+	progressUploading = "uploading"
+	progressCompleted = "completed"
+	progressFailed    = "failed"
+)
+
+type Progress struct {
+	ID                  string     `json:"id"`
+	State               string     `json:"state"`
+	Key                 string     `json:"key,omitempty"` // Set once completed.
+	PartsCompleted      int        `json:"partsCompleted"`
+	BytesUploaded       int64      `json:"bytesUploaded"`
+	TotalBytes          int64      `json:"totalBytes,omitempty"` // Zero when the length is unknown.
+	StartedAt           time.Time  `json:"startedAt"`
+	EstimatedCompletion *time.Time `json:"estimatedCompletion,omitempty"`
+}
+
+// uploadProgress tracks the parts of an upload stored so far. Its methods do nothing on nil, for
+// uploads sent without an X-Upload-Id.
+type uploadProgress struct {
+	mu       sync.Mutex
+	progress Progress
+}
+
+func (p *uploadProgress) partUploaded(size int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.progress.PartsCompleted++
+	p.progress.BytesUploaded += size
+}
+
+// complete records the key of the upload, which succeeded.
+func (p *uploadProgress) complete(key string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.progress.State = progressCompleted
+	p.progress.Key = key
+}
+
+// snapshot returns the progress, with the completion estimated from the average upload rate
+// when the length of the upload is known.
+func (p *uploadProgress) snapshot() Progress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	snapshot := p.progress
+	elapsed := time.Since(snapshot.StartedAt)
+	if snapshot.State == progressUploading && snapshot.TotalBytes > 0 && snapshot.BytesUploaded > 0 {
+		remaining := time.Duration(float64(elapsed) * float64(snapshot.TotalBytes-snapshot.BytesUploaded) / float64(snapshot.BytesUploaded))
+		estimate := time.Now().Add(remaining).Truncate(time.Second)
+		snapshot.EstimatedCompletion = &estimate
+	}
+	return snapshot
+}
+
+// progressStore keeps the progress of the uploads sent with an X-Upload-Id, by ID.
+type progressStore struct {
+	mu      sync.Mutex
+	uploads map[string]*uploadProgress
+}
+
+var uploadProgresses = &progressStore{uploads: make(map[string]*uploadProgress)}
+
+// start tracks a new upload of total bytes, zero when unknown, unless one with the same ID is
+// tracked.
+func (s *progressStore) start(id string, total int64) (*uploadProgress, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.uploads[id]; ok {
+		return nil, false
+	}
+	if total < 0 {
+		total = 0
+	}
+	p := &uploadProgress{progress: Progress{
+		ID:         id,
+		State:      progressUploading,
+		TotalBytes: total,
+		StartedAt:  time.Now().Truncate(time.Second),
+	}}
+	s.uploads[id] = p
+	return p, true
+}
+
+// finish marks the upload failed unless it completed, and forgets it after progressRetention.
+func (s *progressStore) finish(p *uploadProgress) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	if p.progress.State == progressUploading {
+		p.progress.State = progressFailed
+	}
+	id := p.progress.ID
+	p.mu.Unlock()
+	time.AfterFunc(progressRetention, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.uploads, id)
+	})
+}
+
+func (s *progressStore) get(id string) (*uploadProgress, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.uploads[id]
+	return p, ok
+}
+
+// writeProgress answers GET /api/v1/uploads/{id}/progress with the progress of the upload as
+// JSON, or as Server-Sent Events every second until it finishes when the client accepts
+// text/event-stream.
+func writeProgress(w http.ResponseWriter, r *http.Request, id string) {
+	p, ok := uploadProgresses.get(keyPrefix(r) + id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no such upload")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok || !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		snapshot := p.snapshot()
+		snapshot.ID = id
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		snapshot := p.snapshot()
+		snapshot.ID = id
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+		if snapshot.State != progressUploading {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
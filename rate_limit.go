@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunkSize bounds the bytes read at once from a throttled body, so that concurrent
+// uploads draw from the rate limiter in small turns.
+const throttleChunkSize = 32 * 1024
+
+// uploadRate is nil when GLOBAL_MAX_BYTES_PER_SEC is not set.
+var uploadRate *tokenBucket
+
+// tokenBucket is a rate limiter shared by every upload. Readers reserve the bytes they read and
+// wait until the bucket refills to cover them; as reservations are served in the order they are
+// made, concurrent uploads reading in chunks of the same size get an even share of the rate.
+type tokenBucket struct {
+	rate float64 // Bytes per second.
+
+	mu     sync.Mutex
+	tokens float64 // Negative when reservations wait for the bucket to refill.
+	last   time.Time
+}
+
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// refill adds the tokens accrued since the last use of the bucket. The caller holds the lock.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate // One second of burst.
+	}
+	b.last = now
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before using them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take takes n from the bucket if it holds them, and reports whether it did.
+func (b *tokenBucket) take(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// idleSince returns when the bucket was last used.
+func (b *tokenBucket) idleSince() time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.last
+}
+
+// throttledReader reads from an upload body at the rate of the token bucket.
+type throttledReader struct {
+	ctx    context.Context
+	reader io.Reader
+	bucket *tokenBucket
+}
+
+// throttle returns the body limited to the global upload rate, if any.
+func throttle(ctx context.Context, body io.Reader) io.Reader {
+	if uploadRate == nil {
+		return body
+	}
+	return &throttledReader{ctx: ctx, reader: body, bucket: uploadRate}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := r.reader.Read(p)
+	if delay := r.bucket.reserve(n); delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return n, err
+}
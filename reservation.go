@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Key reservation backends selectable through KEY_RESERVATION.
+const (
+	keyReservationMemory   = "memory"
+	keyReservationDynamoDB = "dynamodb"
+)
+
+// KeyReservation lets a single upload at a time work on a key, across every instance sharing
+// the same backend. Reservations expire after their TTL, so that the ones of crashed instances
+// do not block the key forever.
+type KeyReservation interface {
+	// Reserve reports whether the key was reserved, false when another upload holds it.
+	Reserve(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	Release(ctx context.Context, key string) error
+}
+
+var (
+	keyReservation     KeyReservation // nil when reservations are disabled.
+	keyReservationTTL  = 15 * time.Minute
+	keyReservationWait time.Duration // Zero answers 409 Conflict at once.
+)
+
+var errKeyReserved = errors.New("key reserved by another upload")
+
+// memoryKeyReservation is a KeyReservation local to the process.
+type memoryKeyReservation struct {
+	mu           sync.Mutex
+	reservations map[string]time.Time
+}
+
+func newMemoryKeyReservation() *memoryKeyReservation {
+	return &memoryKeyReservation{reservations: make(map[string]time.Time)}
+}
+
+func (m *memoryKeyReservation) Reserve(_ context.Context, key string, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if expiresAt, ok := m.reservations[key]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+	m.reservations[key] = now.Add(ttl)
+	for key, expiresAt := range m.reservations {
+		if !now.Before(expiresAt) {
+			delete(m.reservations, key)
+		}
+	}
+	return true, nil
+}
+
+func (m *memoryKeyReservation) Release(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.reservations, key)
+	return nil
+}
+
+// dynamoDBKeyReservation is a KeyReservation shared by every instance, holding one item per
+// reserved key in a table whose partition key is the "key" string attribute. Items are written
+// with conditional puts, and carry the ID of their owner so that an instance never releases a
+// reservation another one took over after it expired.
+type dynamoDBKeyReservation struct {
+	client *dynamodb.Client
+	table  string
+	owner  string
+}
+
+func newDynamoDBKeyReservation(client *dynamodb.Client, table string) *dynamoDBKeyReservation {
+	return &dynamoDBKeyReservation{client: client, table: table, owner: uuid.New().String()}
+}
+
+func (d *dynamoDBKeyReservation) Reserve(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]dynamodbtypes.AttributeValue{
+			"key":       &dynamodbtypes.AttributeValueMemberS{Value: key},
+			"owner":     &dynamodbtypes.AttributeValueMemberS{Value: d.owner},
+			"expiresAt": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(ttl).Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(#key) OR expiresAt <= :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#key": "key",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":now": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+	})
+	var conditionFailed *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *dynamoDBKeyReservation) Release(ctx context.Context, key string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]dynamodbtypes.AttributeValue{
+			"key": &dynamodbtypes.AttributeValueMemberS{Value: key},
+		},
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{
+			"#owner": "owner",
+		},
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":owner": &dynamodbtypes.AttributeValueMemberS{Value: d.owner},
+		},
+	})
+	var conditionFailed *dynamodbtypes.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil
+	}
+	return err
+}
+
+// reserveKey reserves the key, waiting up to keyReservationWait for another upload to release
+// it, and returns errKeyReserved if it did not in time.
+func reserveKey(ctx context.Context, key string) error {
+	deadline := time.Now().Add(keyReservationWait)
+	for {
+		ok, err := keyReservation.Reserve(ctx, key, keyReservationTTL)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			return errKeyReserved
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
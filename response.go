@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Media types of the upload responses, negotiated through the Accept header.
+const (
+	mediaTypeV1 = "application/vnd.upload.v1+json"
+	mediaTypeV2 = "application/vnd.upload.v2+json"
+)
+
+// MessageV1 is the original response shape, kept for the clients not asking for a version.
+// The staging fields are only set with ENABLE_STAGING, without which v1 responses keep their
+// original shape.
+type MessageV1 struct {
+	Key          string `json:"key"`
+	Links        []Link `json:"links"`
+	StagingKey   string `json:"stagingKey,omitempty"`
+	ConfirmToken string `json:"confirmToken,omitempty"`
+}
+
+// acceptsV2 reports whether the Accept header asks for the v2 responses.
+func acceptsV2(accept string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(mediaRange)
+		if err == nil && mediaType == mediaTypeV2 {
+			return true
+		}
+	}
+	return false
+}
+
+// linkHeader formats the link as a value of the Link header. The object link, which has no
+// relation, is answered as "rel=item".
+func linkHeader(link Link) string {
+	rel := link.Rel
+	if rel == "" {
+		rel = "item"
+	}
+	return fmt.Sprintf("<%s>; rel=%q", link.URL, rel)
+}
+
+// writeMessage writes the message in the version negotiated by the request, v1 by default.
+func writeMessage(w http.ResponseWriter, r *http.Request, statusCode int, message Message) {
+	var body interface{} = MessageV1{
+		Key:          message.Key,
+		Links:        message.Links,
+		StagingKey:   message.StagingKey,
+		ConfirmToken: message.ConfirmToken,
+	}
+	contentType := "application/json"
+	if acceptsV2(r.Header.Get("Accept")) {
+		body = message
+		contentType = mediaTypeV2
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logEntry(r.Context(), logLevelError, "writing response failed", "error", err)
+	}
+}
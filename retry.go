@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"strconv"
+	"strings"
+)
+
+// Error codes and HTTP status codes of Amazon S3 responses worth retrying. They default to the
+// ones of the AWS SDK and can be replaced for S3 compatible stores reporting the same
+// conditions differently.
+var (
+	retryableErrorCodes  = make(map[string]struct{})
+	retryableStatusCodes = make(map[int]struct{})
+)
+
+// maxAttempts is the number of attempts of the Amazon S3 calls but UploadPart, such as
+// CompleteMultipartUpload and AbortMultipartUpload, with exponential backoff and jitter.
+var maxAttempts = retry.DefaultMaxAttempts
+
+func init() {
+	for code := range retry.DefaultRetryableErrorCodes {
+		retryableErrorCodes[code] = struct{}{}
+	}
+	for code := range retry.DefaultThrottleErrorCodes {
+		retryableErrorCodes[code] = struct{}{}
+	}
+	for code := range retry.DefaultRetryableHTTPStatusCodes {
+		retryableStatusCodes[code] = struct{}{}
+	}
+}
+
+// parseErrorCodes parses a comma separated list of error codes.
+func parseErrorCodes(s string) map[string]struct{} {
+	codes := make(map[string]struct{})
+	for _, code := range strings.Split(s, ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			codes[code] = struct{}{}
+		}
+	}
+	return codes
+}
+
+// parseStatusCodes parses a comma separated list of HTTP status codes.
+func parseStatusCodes(s string) (map[int]struct{}, error) {
+	codes := make(map[int]struct{})
+	for _, code := range strings.Split(s, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue
+		}
+		n, err := strconv.Atoi(code)
+		if err != nil || n < 100 || n > 599 {
+			return nil, fmt.Errorf("invalid HTTP status code %q", code)
+		}
+		codes[n] = struct{}{}
+	}
+	return codes, nil
+}
+
+// retryables classifies which errors the AWS SDK retryer retries on every Amazon S3 call,
+// including CompleteMultipartUpload, and which failed parts uploadPartWithRetries retries.
+func retryables() retry.IsErrorRetryables {
+	return retry.IsErrorRetryables{
+		retry.NoRetryCanceledError{},
+		retry.RetryableError{},
+		retry.RetryableConnectionError{},
+		retry.RetryableHTTPStatusCode{Codes: retryableStatusCodes},
+		retry.RetryableErrorCode{Codes: retryableErrorCodes},
+	}
+}
+
+// newRetryer returns the AWS SDK standard retryer using the configured retryable errors.
+func newRetryer() aws.Retryer {
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.Retryables = retryables()
+		o.MaxAttempts = maxAttempts
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// session is a multipart upload spanning several requests, which the server keeps track of
+// until it is completed: either parts uploaded by the client directly to Amazon S3 through
+// presigned URLs, or chunks of a body sent with Content-Range.
+type session struct {
+	ID             string
+	Bucket         string
+	Key            string
+	UploadID       string
+	ExpiresAt      time.Time
+	ContentType    string
+	PartCount      int32             // Number of parts presigned, zero for chunked sessions.
+	Metadata       map[string]string // User-defined metadata of the object.
+	LifecycleHints map[string]string // Lifecycle hints of the object.
+	Tags           map[string]string // Tags of the object, the hints aside.
+
+	// The X-Encryption and X-Encryption-Context of the request starting the upload, and the MD5
+	// of its SSE-C key, whose key is not stored. See sessionEncryption.
+	Encryption        string
+	EncryptionContext string
+	CustomerKeyMD5    string
+
+	// Only used by chunked sessions.
+	Size   int64 // Total size declared by Content-Range.
+	Offset int64 // Next expected byte.
+	Parts  []types.CompletedPart
+	busy   bool
+}
+
+// setEncryption records the encryption the upload of the session is started with, parsed from
+// the headers of r.
+func (s *session) setEncryption(r *http.Request, e encryption) {
+	s.Encryption = r.Header.Get("X-Encryption")
+	s.EncryptionContext = r.Header.Get("X-Encryption-Context")
+	s.CustomerKeyMD5 = aws.ToString(e.customerKeyMD5)
+}
+
+// sessionStore keeps the sessions in memory.
+type sessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+}
+
+var errSessionBusy = errors.New("session busy")
+
+var (
+	sessions        = &sessionStore{sessions: make(map[string]session)}
+	chunkedSessions = &sessionStore{sessions: make(map[string]session)}
+)
+
+func (s *sessionStore) put(session session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+}
+
+func (s *sessionStore) get(id string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	return session, ok
+}
+
+// acquire returns the session and marks it busy until it is released, so that a single request
+// at a time works on it.
+func (s *sessionStore) acquire(id string) (session, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok {
+		return session, false, nil
+	}
+	if session.busy {
+		return session, true, errSessionBusy
+	}
+	session.busy = true
+	s.sessions[id] = session
+	return session, true, nil
+}
+
+// create stores a new busy session, unless one with the same ID exists.
+func (s *sessionStore) create(session session) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[session.ID]; ok {
+		return false
+	}
+	session.busy = true
+	s.sessions[session.ID] = session
+	return true
+}
+
+// release stores the session and makes it available to the next request.
+func (s *sessionStore) release(session session) {
+	session.busy = false
+	s.put(session)
+}
+
+func (s *sessionStore) delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+}
+
+// expired removes and returns the sessions that expired before t.
+func (s *sessionStore) expired(t time.Time) []session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []session
+	for id, session := range s.sessions {
+		if session.ExpiresAt.Before(t) && !session.busy {
+			expired = append(expired, session)
+			delete(s.sessions, id)
+		}
+	}
+	return expired
+}
+
+// drain removes and returns every session.
+func (s *sessionStore) drain() []session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	drained := make([]session, 0, len(s.sessions))
+	for id, session := range s.sessions {
+		drained = append(drained, session)
+		delete(s.sessions, id)
+	}
+	return drained
+}
+
+// sweepSessions aborts the multipart upload of every expired session of the stores
+// at each interval.
+func sweepSessions(ctx context.Context, interval time.Duration, stores ...*sessionStore) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			var expired []session
+			for _, store := range stores {
+				expired = append(expired, store.expired(t)...)
+			}
+			abortSessions(ctx, expired)
+		}
+	}
+}
+
+// abortSessions aborts the multipart upload of every session.
+func abortSessions(ctx context.Context, sessions []session) {
+	for _, session := range sessions {
+		if err := storage.Abort(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(session.Bucket),
+			Key:      aws.String(session.Key),
+			UploadId: aws.String(session.UploadID),
+		}); err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionsPath  = "/api/v1/sessions"
+	maxPartNumber = 10000 // Amazon S3 does not allow more parts per upload.
+)
+
+type SessionRequest struct {
+	ContentType string `json:"contentType"`
+	Parts       int32  `json:"parts"`
+}
+
+// CompleteRequest is the optional body of the completion of a session.
+type CompleteRequest struct {
+	Parts []SessionPart `json:"parts"`
+}
+
+type SessionPart struct {
+	PartNumber int32  `json:"partNumber"`
+	URL        string `json:"url,omitempty"`
+	ETag       string `json:"etag,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+}
+
+type SessionMessage struct {
+	ID        string        `json:"id"`
+	Bucket    string        `json:"bucket"`
+	Key       string        `json:"key"`
+	ExpiresAt time.Time     `json:"expiresAt"`
+	Parts     []SessionPart `json:"parts"`
+	Links     []Link        `json:"links"`
+}
+
+// sessionHandler serves the presigned upload sessions:
+//
+//	POST /api/v1/sessions               starts a session and returns the presigned part URLs.
+//	GET  /api/v1/sessions/{id}          returns the parts Amazon S3 has confirmed so far.
+//	POST /api/v1/sessions/{id}/complete completes the multipart upload.
+func sessionHandler(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, sessionsPath), "/"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		createSession(w, r)
+	case id != "" && action == "" && r.Method == http.MethodGet:
+		sessionStatus(w, r, id)
+	case id != "" && action == "complete" && r.Method == http.MethodPost:
+		completeSession(w, r, id)
+	case id == "" || action == "" || action == "complete":
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "not found")
+	}
+}
+
+func createSession(w http.ResponseWriter, r *http.Request) {
+	// The parts are uploaded to Amazon S3 directly, where they cannot be counted.
+	if key, ok := requestAPIKey(r); ok && key.DailyQuota > 0 {
+		writeError(w, http.StatusForbidden, "quota_unsupported", "API keys with a quota cannot use presigned sessions")
+		return
+	}
+	if writeShed(w) {
+		return
+	}
+	var request SessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+	if request.Parts < 1 || request.Parts > maxPartNumber {
+		writeError(w, http.StatusBadRequest, "invalid_request", "parts must be between 1 and 10000")
+		return
+	}
+	request.ContentType = normalizeContentType(request.ContentType)
+	if !acceptedContentType(request.ContentType, contentTypes["/api/v1/file"]) {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "unsupported content type")
+		return
+	}
+	encryption, err := requestEncryption(r)
+	if err != nil {
+		writeEncryptionError(w, err)
+		return
+	}
+	// The parts are uploaded to Amazon S3 directly, which would need the customer key too.
+	if encryption.customerKey != nil {
+		writeError(w, http.StatusBadRequest, "invalid_encryption", "presigned sessions cannot be encrypted with a customer key")
+		return
+	}
+	if rejectsVideo(request.ContentType, encryption) {
+		writeError(w, http.StatusUnprocessableEntity, "poster_unavailable", "a poster cannot be extracted from the video")
+		return
+	}
+	metadata, err := requestMetadata(r.Header)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	lock, hints, tags, ok := requestRetention(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	session := session{
+		ID:             uuid.New().String(),
+		Bucket:         resolveBucket(request.ContentType),
+		Key:            keyPrefix(r) + newKey(request.ContentType),
+		ExpiresAt:      time.Now().Add(sessionTTL),
+		PartCount:      request.Parts,
+		ContentType:    request.ContentType,
+		Metadata:       metadata,
+		LifecycleHints: hints,
+		Tags:           tags,
+	}
+	session.setEncryption(r, encryption)
+	multipartUploadOutput, err := client.CreateMultipartUpload(ctx, newCreateMultipartUploadInput(session.Bucket, session.Key, request.ContentType,
+		withEncryption(encryption),
+		withObjectLock(lock),
+		withStorageClass(defaultStorageClass),
+		withTags(hints, tags),
+		withMetadata(metadata),
+	))
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	session.UploadID = *multipartUploadOutput.UploadId
+	presignClient := s3.NewPresignClient(client, s3.WithPresignExpires(sessionTTL))
+	parts := make([]SessionPart, 0, request.Parts)
+	for partNumber := int32(1); partNumber <= request.Parts; partNumber++ {
+		presignedRequest, err := presignClient.PresignUploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     aws.String(session.Bucket),
+			Key:        aws.String(session.Key),
+			PartNumber: partNumber,
+			UploadId:   aws.String(session.UploadID),
+		})
+		if err != nil {
+			abortMultipartUpload(ctx, multipartUploadOutput)
+			writeS3Error(w, r, err)
+			return
+		}
+		parts = append(parts, SessionPart{
+			PartNumber: partNumber,
+			URL:        presignedRequest.URL,
+		})
+	}
+	sessions.put(session)
+	writeSession(w, http.StatusCreated, sessionsPath, session, parts)
+}
+
+func sessionStatus(w http.ResponseWriter, r *http.Request, id string) {
+	session, ok := sessions.get(id)
+	if !ok || !ownsKey(r, session.Key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such session")
+		return
+	}
+	writeSessionStatus(w, r, sessionsPath, session)
+}
+
+// writeSessionStatus answers with the parts of the session that Amazon S3 has confirmed.
+func writeSessionStatus(w http.ResponseWriter, r *http.Request, basePath string, session session) {
+	uploadedParts, err := listParts(r.Context(), session)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	parts := make([]SessionPart, 0, len(uploadedParts))
+	for _, part := range uploadedParts {
+		parts = append(parts, SessionPart{
+			PartNumber: part.PartNumber,
+			ETag:       aws.ToString(part.ETag),
+			Size:       part.Size,
+		})
+	}
+	writeSession(w, http.StatusOK, basePath, session, parts)
+}
+
+func completeSession(w http.ResponseWriter, r *http.Request, id string) {
+	session, ok := sessions.get(id)
+	if !ok || !ownsKey(r, session.Key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such session")
+		return
+	}
+	completeParts(w, r, session, func() error {
+		sessions.delete(session.ID)
+		return nil
+	})
+}
+
+// completeParts completes the multipart upload of the session from the parts Amazon S3 has
+// confirmed, and calls remove to forget the session once it is completed. Sessions whose parts
+// are missing or undersized are kept, so that those parts can be uploaded again.
+func completeParts(w http.ResponseWriter, r *http.Request, session session, remove func() error) {
+	encryption, err := sessionEncryption(r, session)
+	if err != nil {
+		writeEncryptionError(w, err)
+		return
+	}
+	ctx := r.Context()
+	uploadedParts, err := listParts(ctx, session)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	// Clients may send the ETags Amazon S3 answered their parts with, to complete only those parts
+	// and check that they were not replaced since.
+	var request CompleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+	if len(request.Parts) > 0 {
+		uploadedParts, err = selectParts(uploadedParts, request.Parts)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "etag_mismatch", err.Error())
+			return
+		}
+	}
+	if len(uploadedParts) == 0 {
+		writeError(w, http.StatusBadRequest, "no_parts", "no part was uploaded")
+		return
+	}
+	completedParts := make([]types.CompletedPart, 0, len(uploadedParts))
+	var size int64
+	for _, part := range uploadedParts {
+		completedParts = append(completedParts, types.CompletedPart{
+			ETag:       part.ETag,
+			PartNumber: part.PartNumber,
+		})
+		size += part.Size
+	}
+	if err := sortCompletedParts(completedParts); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if missing := missingParts(completedParts, session.PartCount); len(missing) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		if err := json.NewEncoder(w).Encode(MissingPartsMessage{MissingParts: missing}); err != nil {
+			logEntry(r.Context(), logLevelError, "writing response failed", "error", err)
+		}
+		return
+	}
+	if undersized := undersizedParts(uploadedParts); len(undersized) > 0 {
+		writePartSizes(w, r, session, undersized)
+		return
+	}
+	completeMultipartUploadOutput, err := storage.Complete(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(session.Bucket),
+		Key:      aws.String(session.Key),
+		UploadId: aws.String(session.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	if entityTooSmall(err) {
+		writePartSizes(w, r, session, undersizedParts(uploadedParts))
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if err := remove(); err != nil {
+		logEntry(r.Context(), logLevelError, "removing session failed", "error", err)
+	}
+	recentUploads.add(session.Bucket, session.Key)
+	links := []Link{
+		{
+			URL: objectURL(ctx, session.Bucket, session.Key, *completeMultipartUploadOutput.Location),
+		},
+	}
+	poster, err := attachPoster(ctx, session.Bucket, session.Key, *completeMultipartUploadOutput.Location, session.ContentType, encryption)
+	if err != nil {
+		writePosterError(w, r, err)
+		return
+	}
+	if poster != nil {
+		links = append(links, *poster)
+	}
+	links = append(links, notifyUploaded(webhookURL, Notification{
+		Bucket:      session.Bucket,
+		Key:         session.Key,
+		ContentType: session.ContentType,
+		Size:        size,
+		Metadata:    session.Metadata,
+		Links:       links,
+	})...)
+	writeMessage(w, r, http.StatusCreated, Message{
+		Bucket:         session.Bucket,
+		Key:            session.Key,
+		Links:          links,
+		LifecycleHints: session.LifecycleHints,
+		Tags:           session.Tags,
+		Metadata:       session.Metadata,
+		VersionID:      aws.ToString(completeMultipartUploadOutput.VersionId),
+	})
+}
+
+// writePartSizes answers a completion that Amazon S3 rejects, or would reject, with EntityTooSmall.
+func writePartSizes(w http.ResponseWriter, r *http.Request, session session, undersized []SessionPart) {
+	logEntry(r.Context(), logLevelInfo, "parts too small", "session", session.ID, "minPartSize", minUploadPartSize, "undersizedParts", undersized)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(PartSizeMessage{
+		MinPartSize:     minUploadPartSize,
+		UndersizedParts: undersized,
+	}); err != nil {
+		logEntry(r.Context(), logLevelError, "writing response failed", "error", err)
+	}
+}
+
+// listParts returns every part of the session's multipart upload that Amazon S3 has confirmed,
+// in ascending part number order.
+func listParts(ctx context.Context, session session) ([]types.Part, error) {
+	var parts []types.Part
+	paginator := s3.NewListPartsPaginator(client, &s3.ListPartsInput{
+		Bucket:   aws.String(session.Bucket),
+		Key:      aws.String(session.Key),
+		UploadId: aws.String(session.UploadID),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, page.Parts...)
+	}
+	return parts, nil
+}
+
+func writeSession(w http.ResponseWriter, statusCode int, basePath string, session session, parts []SessionPart) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(SessionMessage{
+		ID:        session.ID,
+		Bucket:    session.Bucket,
+		Key:       session.Key,
+		ExpiresAt: session.ExpiresAt,
+		Parts:     parts,
+		Links: []Link{
+			{
+				Rel: "status",
+				URL: basePath + "/" + session.ID,
+			},
+			{
+				Rel: "complete",
+				URL: basePath + "/" + session.ID + "/complete",
+			},
+		},
+	}); err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// shutdownTimeout is the time the requests in flight get to finish once a shutdown signal is
+// received.
+var shutdownTimeout = 30 * time.Second
+
+// abortTimeout is the time the requests still in flight after shutdownTimeout get to abort their
+// multipart uploads once they are cancelled.
+const abortTimeout = 10 * time.Second
+
+// serve serves the handler on the listener until SIGINT or SIGTERM is received, then stops
+// accepting connections and waits for the requests in flight. Those still running after
+// shutdownTimeout are cancelled and their connections closed, so that their uploads fail and
+// abort their multipart uploads before the process exits.
+func serve(listener net.Listener, handler http.Handler) error {
+	baseCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var inFlight sync.WaitGroup
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inFlight.Add(1)
+			defer inFlight.Done()
+			handler.ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	select {
+	case err := <-errs:
+		return err
+	case s := <-signals:
+		log.Printf("received %v, shutting down", s)
+	}
+	ctx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(ctx); err == nil {
+		return nil
+	}
+	log.Printf("requests still in flight after %v, cancelling them", shutdownTimeout)
+	cancel()
+	if err := server.Close(); err != nil {
+		log.Print(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(abortTimeout):
+		log.Printf("requests still in flight after %v, their multipart uploads may not be aborted", abortTimeout)
+	}
+	return nil
+}
+
+// abortStoredSessions aborts the multipart uploads of the sessions kept in memory once the server
+// stopped, as they cannot be completed by another process.
+func abortStoredSessions(stores ...*sessionStore) {
+	var drained []session
+	for _, store := range stores {
+		drained = append(drained, store.drain()...)
+	}
+	if len(drained) == 0 {
+		return
+	}
+	log.Printf("aborting the multipart uploads of %d sessions", len(drained))
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	abortSessions(ctx, drained)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startServe serves handler with serve on a local listener, and returns its address and the
+// channel receiving the result of serve.
+func startServe(t *testing.T, handler http.HandlerFunc) (string, chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(listener, handler)
+	}()
+	return listener.Addr().String(), served
+}
+
+// terminate sends SIGTERM to the process until the server at addr stops accepting connections.
+func terminate(t *testing.T, addr string) {
+	t.Helper()
+	// The test process must not be terminated if serve is not notified yet.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}
+	t.Fatal("the server did not shut down")
+}
+
+func TestServeDrainsRequests(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	addr, served := startServe(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "uploaded")
+	})
+	responses := make(chan string, 1)
+	go func() {
+		response, err := http.Get("http://" + addr)
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		responses <- string(body)
+	}()
+	<-started
+	terminate(t, addr)
+	close(release)
+	if body := <-responses; body != "uploaded" {
+		t.Errorf("got %q, want the request to finish", body)
+	}
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestServeCancelsRequestsAfterTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { shutdownTimeout = timeout }(shutdownTimeout)
+	shutdownTimeout = 50 * time.Millisecond
+	started, canceled := make(chan struct{}), make(chan struct{})
+	addr, served := startServe(t, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		// Uploads abort their multipart upload once their context is cancelled.
+		<-r.Context().Done()
+		close(canceled)
+	})
+	go func() {
+		if response, err := http.Get("http://" + addr); err == nil {
+			response.Body.Close()
+		}
+	}()
+	<-started
+	terminate(t, addr)
+	if err := <-served; err != nil {
+		t.Error(err)
+	}
+	select {
+	case <-canceled:
+	default:
+		t.Error("serve returned before the request was cancelled")
+	}
+}
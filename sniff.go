@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// sniffLength is the number of bytes http.DetectContentType considers.
+const sniffLength = 512
+
+// sniffAliases lists, for declared types sharing their signature with another type, the other
+// sniffed types they are allowed to match.
+var sniffAliases = map[string][]string{
+	"video/quicktime":  {"video/mp4"},
+	"video/x-matroska": {"video/webm"},
+}
+
+// sniffBody reads the start of body and returns the content type sniffed from it, with a reader
+// yielding the whole body again, sniffed bytes included.
+func sniffBody(body io.Reader) (string, io.Reader, error) {
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(body, head)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", nil, err
+	}
+	head = head[:n]
+	return sniffContentType(head), io.MultiReader(bytes.NewReader(head), body), nil
+}
+
+// sniffContentType extends http.DetectContentType with the signatures of the accepted
+// media types it does not know.
+func sniffContentType(data []byte) string {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" {
+		switch string(data[8:12]) {
+		case "qt  ":
+			return "video/quicktime"
+		case "avif", "avis":
+			return "image/avif"
+		}
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		return "video/ogg"
+	case bytes.HasPrefix(data, []byte{0x00, 0x00, 0x01, 0xba}), bytes.HasPrefix(data, []byte{0x00, 0x00, 0x01, 0xb3}):
+		return "video/mpeg"
+	}
+	return normalizeContentType(http.DetectContentType(data))
+}
+
+// matchesSniffed reports whether the sniffed type is accepted by the route and agrees with the
+// declared one.
+func matchesSniffed(declared, sniffed string, prefixes []string) bool {
+	if !hasContentTypePrefix(sniffed, prefixes) {
+		return false
+	}
+	if sniffed == declared {
+		return true
+	}
+	for _, alias := range sniffAliases[declared] {
+		if sniffed == alias {
+			return true
+		}
+	}
+	return false
+}
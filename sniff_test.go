@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var (
+	pngHeader  = "\x89PNG\r\n\x1a\n"
+	jpegHeader = "\xff\xd8\xff\xe0\x00\x10JFIF\x00"
+)
+
+func TestSniffBody(t *testing.T) {
+	body := jpegHeader + strings.Repeat("x", 2*sniffLength)
+	sniffed, reader, err := sniffBody(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sniffed != "image/jpeg" {
+		t.Errorf("sniffed %q, want image/jpeg", sniffed)
+	}
+	read, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, []byte(body)) {
+		t.Errorf("read %d bytes, want the %d bytes of the body", len(read), len(body))
+	}
+}
+
+func TestMatchesSniffed(t *testing.T) {
+	imagesAndVideos := contentTypes["/api/v1/file"]
+	tests := []struct {
+		name     string
+		declared string
+		body     string
+		prefixes []string
+		want     bool
+	}{
+		{name: "genuine JPEG", declared: "image/jpeg", body: jpegHeader, prefixes: imagesAndVideos, want: true},
+		{name: "genuine PNG", declared: "image/png", body: pngHeader, prefixes: imagesAndVideos, want: true},
+		{name: "MP4 declared as QuickTime", declared: "video/quicktime", body: "\x00\x00\x00\x18ftypmp42\x00\x00\x00\x00isommp42", prefixes: imagesAndVideos, want: true},
+		{name: "spoofed PNG", declared: "image/png", body: "<html><script>alert(1)</script></html>", prefixes: imagesAndVideos},
+		{name: "JPEG declared as PNG", declared: "image/png", body: jpegHeader, prefixes: imagesAndVideos},
+		{name: "image on the videos route", declared: "image/png", body: pngHeader, prefixes: contentTypes["/api/v1/videos"]},
+	}
+	for _, test := range tests {
+		sniffed, _, err := sniffBody(strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matchesSniffed(test.declared, sniffed, test.prefixes); got != test.want {
+			t.Errorf("%s: sniffed %q, matches %t, want %t", test.name, sniffed, got, test.want)
+		}
+	}
+}
+
+func TestUploadFileRejectsSpoofedContentType(t *testing.T) {
+	defer func(s Storage, size int64) { storage, maxContentSize = s, size }(storage, maxContentSize)
+	s := &failingStorage{filesystemStorage: filesystemStorage{dir: t.TempDir()}}
+	storage, maxContentSize = s, minUploadPartSize
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/file", strings.NewReader("<html><script>alert(1)</script></html>"))
+	r.Header.Set("Content-Type", "image/png")
+	w := httptest.NewRecorder()
+	uploadFile(w, r, nil)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
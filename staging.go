@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const stagedPath = "/api/v1/staged"
+
+var (
+	enableStaging bool
+	stagingPrefix = "staging/"
+	stagingTTL    = 24 * time.Hour
+	staged        = &stagingStore{objects: make(map[string]stagedObject)}
+)
+
+// stagedObject is an upload stored under the staging prefix until it is confirmed.
+type stagedObject struct {
+	Bucket       string
+	Key          string // Final key.
+	Location     string // Location of the staged object.
+	Token        string
+	ContentType  string
+	Size         int64
+	Hash         string
+	Deduplicate  bool // Whether the hash is added to the dedup index once confirmed.
+	Callback     string
+	Metadata     map[string]string
+	Encryption   encryption // Without the customer key, which is sent again to confirm.
+	Lock         objectLock
+	StorageClass types.StorageClass
+	Poster       bool // Whether a poster is stored under the poster key of the staged key.
+	ExpiresAt    time.Time
+}
+
+// stagingStore keeps the staged objects in memory, by final key.
+type stagingStore struct {
+	mu      sync.Mutex
+	objects map[string]stagedObject
+}
+
+func (s *stagingStore) put(object stagedObject) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[object.Key] = object
+}
+
+// take removes and returns the staged object if the token is its confirm token.
+func (s *stagingStore) take(key, token string) (stagedObject, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	object, ok := s.objects[key]
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(object.Token)) != 1 {
+		return stagedObject{}, false
+	}
+	delete(s.objects, key)
+	return object, true
+}
+
+// expired removes and returns the staged objects that expired before t.
+func (s *stagingStore) expired(t time.Time) []stagedObject {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []stagedObject
+	for key, object := range s.objects {
+		if object.ExpiresAt.Before(t) {
+			expired = append(expired, object)
+			delete(s.objects, key)
+		}
+	}
+	return expired
+}
+
+// stagedKey returns the key the object is stored under until it is confirmed, which is the key
+// itself when staging is disabled.
+func stagedKey(key string) string {
+	if !enableStaging {
+		return key
+	}
+	return stagingPrefix + key
+}
+
+func confirmToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// stagedHandler serves POST /api/v1/staged/{key}, moving a staged object to its final key when
+// the X-Confirm-Token header holds its confirm token. Objects encrypted with a customer key need
+// the key in X-Encryption-Key again.
+func stagedHandler(w http.ResponseWriter, r *http.Request) {
+	if !enableStaging {
+		writeError(w, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	object, ok := staged.take(strings.TrimPrefix(r.URL.Path, stagedPath+"/"), r.Header.Get("X-Confirm-Token"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no such staged upload or invalid token")
+		return
+	}
+	encryption := object.Encryption
+	if encryption.mode == encryptionCustomer {
+		var err error
+		encryption, err = parseEncryption(encryptionCustomer, r.Header.Get("X-Encryption-Key"), "", []string{encryptionCustomer})
+		if err != nil || *encryption.customerKeyMD5 != *object.Encryption.customerKeyMD5 {
+			staged.put(object)
+			writeError(w, http.StatusBadRequest, "invalid_encryption", "invalid X-Encryption-Key")
+			return
+		}
+	}
+	ctx := r.Context()
+	versionID, err := moveObject(ctx, object.Bucket, stagedKey(object.Key), object.Key, object.Size, encryption, object.Lock, object.StorageClass, nil)
+	if err != nil {
+		staged.put(object)
+		writeS3Error(w, r, err)
+		return
+	}
+	recentUploads.add(object.Bucket, object.Key)
+	location := strings.TrimSuffix(object.Location, stagedKey(object.Key)) + object.Key
+	links := []Link{
+		{
+			URL: objectURL(ctx, object.Bucket, object.Key, location),
+		},
+	}
+	if object.Poster {
+		if _, err := moveObject(ctx, object.Bucket, posterKey(stagedKey(object.Key)), posterKey(object.Key), 0, encryption, objectLock{}, object.StorageClass, nil); err != nil {
+			logEntry(ctx, logLevelError, "moving poster failed", "error", err)
+		} else {
+			links = append(links, Link{
+				Rel: "poster",
+				URL: objectURL(ctx, object.Bucket, posterKey(object.Key), posterKey(location)),
+			})
+		}
+	}
+	if object.Deduplicate {
+		if err := dedupIndex.Add(ctx, object.Hash, DedupEntry{Bucket: object.Bucket, Key: object.Key}); err != nil {
+			logEntry(ctx, logLevelError, "indexing duplicate failed", "error", err)
+		}
+	}
+	links = append(links, notifyUploaded(object.Callback, Notification{
+		Bucket:      object.Bucket,
+		Key:         object.Key,
+		ContentType: object.ContentType,
+		Size:        object.Size,
+		Metadata:    object.Metadata,
+		Links:       links,
+	})...)
+	writeMessage(w, r, http.StatusOK, Message{
+		Bucket:    object.Bucket,
+		Key:       object.Key,
+		Links:     links,
+		Size:      object.Size,
+		SHA256:    object.Hash,
+		VersionID: versionID,
+	})
+}
+
+// sweepStaged deletes the staged objects left unconfirmed after their TTL at each interval.
+func sweepStaged(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-ticker.C:
+			for _, object := range staged.expired(t) {
+				if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+					Bucket: aws.String(object.Bucket),
+					Key:    aws.String(stagedKey(object.Key)),
+				}); err != nil {
+					log.Print(err)
+				}
+			}
+		}
+	}
+}
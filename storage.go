@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage backends selectable through STORAGE.
+const (
+	storageS3         = "s3"
+	storageFilesystem = "filesystem"
+)
+
+// Storage stores the objects of the uploads. It takes and returns the Amazon S3 types, so that
+// the options of the uploads are built once whatever the backend; backends ignore the fields
+// they do not support. Errors of missing objects and uploads are *types.NoSuchKey and
+// *types.NoSuchUpload, or *types.NotFound for Head.
+//
+// The features relying on other Amazon S3 operations, such as presigned URLs, copies, tagging
+// or the dedup index, need the s3 backend.
+type Storage interface {
+	CreateUpload(ctx context.Context, input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error)
+	// UploadPart is not retried by the backend, as its callers retry it.
+	UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error)
+	Complete(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)
+	Abort(ctx context.Context, input *s3.AbortMultipartUploadInput) error
+	Get(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+	Head(ctx context.Context, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error)
+	// List returns the objects in key order, like ListObjectsV2.
+	List(ctx context.Context, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
+	Delete(ctx context.Context, input *s3.DeleteObjectInput) error
+	// DeleteMany returns the objects it could not delete in the Errors of its output, like
+	// DeleteObjects.
+	DeleteMany(ctx context.Context, input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error)
+}
+
+var (
+	storage        Storage = s3Storage{}
+	storageBackend         = storageS3 // The STORAGE backend storage wraps.
+)
+
+// s3Storage stores the objects in Amazon S3, or an S3 compatible store such as MinIO through
+// S3_ENDPOINT, with the client.
+type s3Storage struct{}
+
+func (s3Storage) CreateUpload(ctx context.Context, input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	return client.CreateMultipartUpload(ctx, input)
+}
+
+func (s3Storage) UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	return client.UploadPart(ctx, input, func(o *s3.Options) {
+		o.Retryer = aws.NopRetryer{}
+	})
+}
+
+func (s3Storage) Complete(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	return client.CompleteMultipartUpload(ctx, input)
+}
+
+func (s3Storage) Abort(ctx context.Context, input *s3.AbortMultipartUploadInput) error {
+	_, err := client.AbortMultipartUpload(ctx, input)
+	return err
+}
+
+func (s3Storage) Get(ctx context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	return client.GetObject(ctx, input)
+}
+
+func (s3Storage) Head(ctx context.Context, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return client.HeadObject(ctx, input)
+}
+
+func (s3Storage) List(ctx context.Context, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return client.ListObjectsV2(ctx, input)
+}
+
+func (s3Storage) Delete(ctx context.Context, input *s3.DeleteObjectInput) error {
+	_, err := client.DeleteObject(ctx, input)
+	return err
+}
+
+func (s3Storage) DeleteMany(ctx context.Context, input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	return client.DeleteObjects(ctx, input)
+}
+
+// filesystemStorage stores the objects under dir/{bucket}/{key} for local development, without
+// any AWS credentials, and the parts of the uploads under dir/.uploads/{upload id}. Objects
+// keep their content type in a ".content-type" file next to them, and are always returned
+// whole, whatever their Range.
+type filesystemStorage struct {
+	dir string
+}
+
+const contentTypeSuffix = ".content-type"
+
+func (s filesystemStorage) objectPath(bucket, key *string) (string, error) {
+	name := aws.ToString(bucket)
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsRune(name, filepath.Separator) {
+		return "", fmt.Errorf("invalid bucket %q", name)
+	}
+	// Clean keeps the paths of keys such as "../x" inside the bucket directory.
+	return filepath.Join(s.dir, name, filepath.Clean("/"+aws.ToString(key))), nil
+}
+
+func (s filesystemStorage) uploadPath(uploadID *string) (string, error) {
+	if _, err := uuid.Parse(aws.ToString(uploadID)); err != nil {
+		return "", &types.NoSuchUpload{}
+	}
+	name := filepath.Join(s.dir, ".uploads", aws.ToString(uploadID))
+	if _, err := os.Stat(name); errors.Is(err, os.ErrNotExist) {
+		return "", &types.NoSuchUpload{}
+	} else if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (s filesystemStorage) CreateUpload(_ context.Context, input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	if _, err := s.objectPath(input.Bucket, input.Key); err != nil {
+		return nil, err
+	}
+	uploadID := uuid.New().String()
+	dir := filepath.Join(s.dir, ".uploads", uploadID)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, contentTypeSuffix), []byte(aws.ToString(input.ContentType)), 0o600); err != nil {
+		return nil, err
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: aws.String(uploadID),
+	}, nil
+}
+
+func (s filesystemStorage) UploadPart(_ context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	dir, err := s.uploadPath(input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return nil, err
+	}
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), input.Body); err != nil {
+		closeTemp(file)
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	if err := os.Rename(file.Name(), filepath.Join(dir, strconv.Itoa(int(input.PartNumber)))); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &s3.UploadPartOutput{ETag: aws.String(`"` + hex.EncodeToString(hash.Sum(nil)) + `"`)}, nil
+}
+
+func (s filesystemStorage) Complete(_ context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	dir, err := s.uploadPath(input.UploadId)
+	if err != nil {
+		return nil, err
+	}
+	name, err := s.objectPath(input.Bucket, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(name), ".object-*")
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range input.MultipartUpload.Parts {
+		if err := appendPart(file, filepath.Join(dir, strconv.Itoa(int(part.PartNumber)))); err != nil {
+			closeTemp(file)
+			return nil, err
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	if err := os.Rename(filepath.Join(dir, contentTypeSuffix), name+contentTypeSuffix); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	if err := os.Rename(file.Name(), name); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		Location: aws.String(downloadPath + aws.ToString(input.Key)),
+	}, nil
+}
+
+func appendPart(file *os.File, name string) error {
+	part, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return &types.NoSuchUpload{Message: aws.String("part " + filepath.Base(name) + " was not uploaded")}
+	} else if err != nil {
+		return err
+	}
+	defer part.Close()
+	_, err = io.Copy(file, part)
+	return err
+}
+
+func (s filesystemStorage) Abort(_ context.Context, input *s3.AbortMultipartUploadInput) error {
+	dir, err := s.uploadPath(input.UploadId)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+func (s filesystemStorage) Get(_ context.Context, input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	name, err := s.objectPath(input.Bucket, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &types.NoSuchKey{}
+	} else if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	contentType, err := os.ReadFile(name + contentTypeSuffix)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &s3.GetObjectOutput{
+		Body:          file,
+		ContentLength: info.Size(),
+		ContentType:   aws.String(string(contentType)),
+		LastModified:  aws.Time(info.ModTime().Truncate(time.Second)),
+	}, nil
+}
+
+func (s filesystemStorage) Delete(_ context.Context, input *s3.DeleteObjectInput) error {
+	name, err := s.objectPath(input.Bucket, input.Key)
+	if err != nil {
+		return err
+	}
+	// Deleting a missing object succeeds, as in Amazon S3.
+	for _, name := range []string{name, name + contentTypeSuffix} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s filesystemStorage) Head(_ context.Context, input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	name, err := s.objectPath(input.Bucket, input.Key)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &types.NotFound{}
+	} else if err != nil {
+		return nil, err
+	}
+	contentType, err := os.ReadFile(name + contentTypeSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: info.Size(),
+		ContentType:   aws.String(string(contentType)),
+		LastModified:  aws.Time(info.ModTime().Truncate(time.Second)),
+	}, nil
+}
+
+// List walks the bucket directory, skipping the content type files and the temporary files of
+// the uploads being completed. Its continuation tokens are the last key of the previous page.
+func (s filesystemStorage) List(_ context.Context, input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	root, err := s.objectPath(input.Bucket, aws.String(""))
+	if err != nil {
+		return nil, err
+	}
+	prefix, after := aws.ToString(input.Prefix), aws.ToString(input.ContinuationToken)
+	var objects []types.Object
+	err = filepath.WalkDir(root, func(name string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(name, contentTypeSuffix) {
+			return nil
+		}
+		key := filepath.ToSlash(strings.TrimPrefix(name, root+string(filepath.Separator)))
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, types.Object{
+			Key:          aws.String(key),
+			Size:         info.Size(),
+			LastModified: aws.Time(info.ModTime().Truncate(time.Second)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The walk orders each directory by name, which does not order the keys: "a.jpg" sorts
+	// before "a/b.jpg", whose directory "a" the walk enters first.
+	sort.Slice(objects, func(i, j int) bool {
+		return aws.ToString(objects[i].Key) < aws.ToString(objects[j].Key)
+	})
+	maxKeys := int(input.MaxKeys)
+	if maxKeys <= 0 {
+		maxKeys = 1000
+	}
+	output := &s3.ListObjectsV2Output{
+		Name:   input.Bucket,
+		Prefix: input.Prefix,
+	}
+	if len(objects) > maxKeys {
+		objects = objects[:maxKeys]
+		output.IsTruncated = true
+		output.NextContinuationToken = objects[maxKeys-1].Key
+	}
+	output.Contents = objects
+	output.KeyCount = int32(len(objects))
+	return output, nil
+}
+
+func (s filesystemStorage) DeleteMany(ctx context.Context, input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		if err := s.Delete(ctx, &s3.DeleteObjectInput{Bucket: input.Bucket, Key: object.Key}); err != nil {
+			output.Errors = append(output.Errors, types.Error{
+				Key:     object.Key,
+				Code:    aws.String("InternalError"),
+				Message: aws.String(err.Error()),
+			})
+		} else if !input.Delete.Quiet {
+			output.Deleted = append(output.Deleted, types.DeletedObject{Key: object.Key})
+		}
+	}
+	return output, nil
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"net/http"
+	"strings"
+)
+
+// storageClasses are the storage classes uploads may select, which serve their objects
+// immediately, unlike the archive classes.
+var storageClasses = []types.StorageClass{
+	types.StorageClassStandard,
+	types.StorageClassStandardIa,
+	types.StorageClassIntelligentTiering,
+	types.StorageClassGlacierIr,
+}
+
+// defaultStorageClass applies to the uploads that do not select one with X-Amz-Storage-Class,
+// and to every session, chunked, resumable and tus upload. Empty leaves it to Amazon S3, which
+// stores them in STANDARD.
+var defaultStorageClass types.StorageClass
+
+// parseStorageClass validates a storage class, ignoring its case.
+func parseStorageClass(s string) (types.StorageClass, error) {
+	class := types.StorageClass(strings.ToUpper(strings.TrimSpace(s)))
+	for _, allowed := range storageClasses {
+		if class == allowed {
+			return class, nil
+		}
+	}
+	return "", fmt.Errorf("invalid storage class %q", s)
+}
+
+// requestStorageClass returns the storage class of the X-Amz-Storage-Class header, which
+// defaults to defaultStorageClass.
+func requestStorageClass(r *http.Request) (types.StorageClass, error) {
+	header := r.Header.Get("X-Amz-Storage-Class")
+	if header == "" {
+		return defaultStorageClass, nil
+	}
+	return parseStorageClass(header)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"testing"
+)
+
+func TestParseStorageClass(t *testing.T) {
+	tests := []struct {
+		class   string
+		want    types.StorageClass
+		wantErr bool
+	}{
+		{class: "STANDARD", want: types.StorageClassStandard},
+		{class: "standard_ia", want: types.StorageClassStandardIa},
+		{class: " Intelligent_Tiering ", want: types.StorageClassIntelligentTiering},
+		{class: "GLACIER_IR", want: types.StorageClassGlacierIr},
+		{class: "", wantErr: true},
+		{class: "GLACIER", wantErr: true},
+		{class: "DEEP_ARCHIVE", wantErr: true},
+		{class: "REDUCED_REDUNDANCY", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseStorageClass(test.class)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parseStorageClass(%q) = %q, want an error", test.class, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseStorageClass(%q): %v", test.class, err)
+		} else if got != test.want {
+			t.Errorf("parseStorageClass(%q) = %q, want %q", test.class, got, test.want)
+		}
+	}
+}
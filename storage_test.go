@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"testing"
+)
+
+// putFilesystemObject stores body under key through a multipart upload of one part per element.
+func putFilesystemObject(t *testing.T, s filesystemStorage, key, contentType string, body ...[]byte) {
+	t.Helper()
+	ctx := context.Background()
+	upload, err := s.CreateUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String("bucket"),
+		Key:         aws.String(key),
+		ContentType: aws.String(contentType),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make([]types.CompletedPart, 0, len(body))
+	for i, part := range body {
+		output, err := s.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket:     upload.Bucket,
+			Key:        upload.Key,
+			UploadId:   upload.UploadId,
+			PartNumber: int32(i + 1),
+			Body:       bytes.NewReader(part),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: output.ETag, PartNumber: int32(i + 1)})
+	}
+	if _, err := s.Complete(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          upload.Bucket,
+		Key:             upload.Key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFilesystemStorageRoundTrip(t *testing.T) {
+	s := filesystemStorage{dir: t.TempDir()}
+	ctx := context.Background()
+	putFilesystemObject(t, s, "a.png", "image/png", []byte("first "), []byte("second"))
+
+	output, err := s.Get(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.png")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(output.Body)
+	output.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "first second" || aws.ToString(output.ContentType) != "image/png" {
+		t.Errorf("got %q of type %q, want %q of type %q", body, aws.ToString(output.ContentType), "first second", "image/png")
+	}
+
+	head, err := s.Head(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.png")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.ContentLength != int64(len("first second")) {
+		t.Errorf("got ContentLength %d, want %d", head.ContentLength, len("first second"))
+	}
+
+	if err := s.Delete(ctx, &s3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.png")}); err != nil {
+		t.Fatal(err)
+	}
+	var notFound *types.NotFound
+	if _, err := s.Head(ctx, &s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.png")}); !errors.As(err, &notFound) {
+		t.Errorf("Head of a deleted object: got %v, want *types.NotFound", err)
+	}
+	var noSuchKey *types.NoSuchKey
+	if _, err := s.Get(ctx, &s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("a.png")}); !errors.As(err, &noSuchKey) {
+		t.Errorf("Get of a deleted object: got %v, want *types.NoSuchKey", err)
+	}
+}
+
+func TestFilesystemStorageCompleteMissingPart(t *testing.T) {
+	s := filesystemStorage{dir: t.TempDir()}
+	ctx := context.Background()
+	upload, err := s.CreateUpload(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String("bucket"),
+		Key:         aws.String("a.png"),
+		ContentType: aws.String("image/png"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Complete(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          upload.Bucket,
+		Key:             upload.Key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: []types.CompletedPart{{PartNumber: 1}}},
+	})
+	var noSuchUpload *types.NoSuchUpload
+	if !errors.As(err, &noSuchUpload) {
+		t.Errorf("got %v, want *types.NoSuchUpload", err)
+	}
+}
+
+func TestFilesystemStorageList(t *testing.T) {
+	s := filesystemStorage{dir: t.TempDir()}
+	for _, key := range []string{"b.png", "a/b.png", "a.png", "c/d.png"} {
+		putFilesystemObject(t, s, key, "image/png", []byte(key))
+	}
+	tests := []struct {
+		name    string
+		prefix  string
+		maxKeys int32
+		want    [][]string // The keys of each page.
+	}{
+		{name: "all", want: [][]string{{"a.png", "a/b.png", "b.png", "c/d.png"}}},
+		{name: "prefix", prefix: "a", want: [][]string{{"a.png", "a/b.png"}}},
+		{name: "directory prefix", prefix: "c/", want: [][]string{{"c/d.png"}}},
+		{name: "no match", prefix: "z", want: [][]string{{}}},
+		{name: "pages", maxKeys: 3, want: [][]string{{"a.png", "a/b.png", "b.png"}, {"c/d.png"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := &s3.ListObjectsV2Input{
+				Bucket:  aws.String("bucket"),
+				Prefix:  aws.String(test.prefix),
+				MaxKeys: test.maxKeys,
+			}
+			for page, want := range test.want {
+				output, err := s.List(context.Background(), input)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := make([]string, 0, len(output.Contents))
+				for _, object := range output.Contents {
+					got = append(got, aws.ToString(object.Key))
+				}
+				if !equalStrings(got, want) {
+					t.Errorf("page %d: got %q, want %q", page, got, want)
+				}
+				if last := page == len(test.want)-1; output.IsTruncated == last {
+					t.Errorf("page %d: got IsTruncated %t", page, output.IsTruncated)
+				}
+				input.ContinuationToken = output.NextContinuationToken
+			}
+		})
+	}
+}
+
+func TestFilesystemStorageDeleteMany(t *testing.T) {
+	s := filesystemStorage{dir: t.TempDir()}
+	putFilesystemObject(t, s, "a.png", "image/png", []byte("a"))
+	output, err := s.DeleteMany(context.Background(), &s3.DeleteObjectsInput{
+		Bucket: aws.String("bucket"),
+		Delete: &types.Delete{Objects: []types.ObjectIdentifier{{Key: aws.String("a.png")}, {Key: aws.String("missing.png")}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Deleting a missing object succeeds, as in Amazon S3.
+	if len(output.Deleted) != 2 || len(output.Errors) != 0 {
+		t.Errorf("got %d deleted and %d errors, want 2 and 0", len(output.Deleted), len(output.Errors))
+	}
+	list, err := s.List(context.Background(), &s3.ListObjectsV2Input{Bucket: aws.String("bucket")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Contents) != 0 {
+		t.Errorf("got %d objects left, want none", len(list.Contents))
+	}
+}
+
+func TestFilesystemStorageKeepsKeysInBucket(t *testing.T) {
+	s := filesystemStorage{dir: t.TempDir()}
+	putFilesystemObject(t, s, "../../outside.png", "image/png", []byte("x"))
+	list, err := s.List(context.Background(), &s3.ListObjectsV2Input{Bucket: aws.String("bucket")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Contents) != 1 || aws.ToString(list.Contents[0].Key) != "outside.png" {
+		t.Errorf("got %d objects, want outside.png inside the bucket", len(list.Contents))
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
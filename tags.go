@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// Amazon S3 limits of object tags.
+const (
+	maxObjectTags     = 10
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+)
+
+// objectTags parses the X-Object-Tagging header, URL query encoded as Amazon S3 expects it,
+// such as "user=42&billing=team-a". The tags are stored along with the lifecycle hints, which are
+// tags too, so they may not replace a hint and count towards the same limit.
+func objectTags(header string, hints map[string]string) (map[string]string, error) {
+	values, err := url.ParseQuery(header)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X-Object-Tagging: %v", err)
+	}
+	tags := make(map[string]string, len(values))
+	for key, value := range values {
+		if len(value) != 1 {
+			return nil, fmt.Errorf("tag %q is repeated", key)
+		}
+		if _, ok := hints[key]; ok {
+			return nil, fmt.Errorf("tag %q is a lifecycle hint", key)
+		}
+		if key == "" || len(key) > maxTagKeyLength || !validTagText(key) || strings.HasPrefix(strings.ToLower(key), "aws:") {
+			return nil, fmt.Errorf("invalid tag key %q", key)
+		}
+		if len(value[0]) > maxTagValueLength || !validTagText(value[0]) {
+			return nil, fmt.Errorf("invalid value of tag %q", key)
+		}
+		tags[key] = value[0]
+	}
+	if len(tags)+len(hints) > maxObjectTags {
+		return nil, fmt.Errorf("%d tags exceed the limit of %d, lifecycle hints included", len(tags)+len(hints), maxObjectTags)
+	}
+	return tags, nil
+}
+
+// validTagText reports whether s only holds the characters Amazon S3 allows in tags: letters,
+// digits, spaces and + - = . _ : / @.
+func validTagText(s string) bool {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune(" +-=._:/@", r) {
+			return false
+		}
+	}
+	return true
+}
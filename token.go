@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const tokensPath = "/api/v1/tokens"
+
+var (
+	tokenSecret       []byte // Empty disables the download tokens.
+	tokenIssuerSecret []byte // Sent in X-Token-Issuer-Secret to issue tokens without API keys.
+	tokenMaxTTL       = 24 * time.Hour
+)
+
+var errInvalidToken = errors.New("invalid download token")
+
+// tokenClaims is the signed content of a download token.
+type tokenClaims struct {
+	Bucket    string `json:"b"`
+	Key       string `json:"k"`
+	ExpiresAt int64  `json:"e"`
+}
+
+type TokenRequest struct {
+	Bucket    string `json:"bucket"`
+	Key       string `json:"key"`
+	ExpiresIn string `json:"expiresIn"`
+}
+
+type TokenMessage struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Links     []Link    `json:"links"`
+}
+
+// signToken returns the base64url encoded claims followed by their HMAC-SHA256.
+func signToken(claims tokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifyToken returns the claims of a token if its signature is valid and it has not expired.
+func verifyToken(token string) (tokenClaims, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return tokenClaims{}, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return tokenClaims{}, errInvalidToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return tokenClaims{}, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, tokenSecret)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return tokenClaims{}, errInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return tokenClaims{}, errInvalidToken
+	}
+	if time.Now().Unix() >= claims.ExpiresAt {
+		return tokenClaims{}, errInvalidToken
+	}
+	return claims, nil
+}
+
+// tokenHandler serves POST /api/v1/tokens, issuing a token granting GET access to one key.
+// Tokens are issued to the requests authenticated with an API key, which only share their own
+// objects, or sending TOKEN_ISSUER_SECRET in X-Token-Issuer-Secret when API keys are disabled.
+// Anyone could share any object otherwise.
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if len(tokenSecret) == 0 {
+		writeError(w, http.StatusNotFound, "not_found", "not found")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+		return
+	}
+	if apiKeys == nil {
+		if len(tokenIssuerSecret) == 0 {
+			writeError(w, http.StatusForbidden, "token_issuer_required", "issuing tokens requires API keys or TOKEN_ISSUER_SECRET")
+			return
+		}
+		if !hmac.Equal([]byte(r.Header.Get("X-Token-Issuer-Secret")), tokenIssuerSecret) {
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid X-Token-Issuer-Secret")
+			return
+		}
+	}
+	var request TokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Key == "" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body or missing key")
+		return
+	}
+	if request.Bucket == "" {
+		request.Bucket = bucket
+	}
+	if !knownBucket(request.Bucket) {
+		writeError(w, http.StatusBadRequest, "invalid_request", "unknown bucket")
+		return
+	}
+	if !servedKey(request.Key) {
+		writeError(w, http.StatusBadRequest, "invalid_key", "the key was not generated by an upload")
+		return
+	}
+	if !ownsKey(r, request.Key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such key")
+		return
+	}
+	ttl := tokenMaxTTL
+	if request.ExpiresIn != "" {
+		var err error
+		ttl, err = time.ParseDuration(request.ExpiresIn)
+		if err != nil || ttl <= 0 || ttl > tokenMaxTTL {
+			writeError(w, http.StatusBadRequest, "invalid_request", "invalid expiresIn")
+			return
+		}
+	}
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	token, err := signToken(tokenClaims{
+		Bucket:    request.Bucket,
+		Key:       request.Key,
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	query := url.Values{"token": {token}}
+	if request.Bucket != bucket {
+		query.Set("bucket", request.Bucket)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(TokenMessage{
+		Token:     token,
+		ExpiresAt: expiresAt,
+		Links: []Link{
+			{
+				Rel: "download",
+				URL: downloadPath + request.Key + "?" + query.Encode(),
+			},
+		},
+	}); err != nil {
+		log.Print(err)
+	}
+}
+
+// acceptToken serves the GET and HEAD requests of /api/v1/file/{key} sending a download token
+// in the token query parameter without an API key, once the token is verified to grant access
+// to their key and bucket. The other requests must be authenticated.
+func acceptToken(next http.HandlerFunc) http.HandlerFunc {
+	authenticated := authenticate(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		if len(tokenSecret) == 0 || token == "" {
+			authenticated(w, r)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			writeError(w, http.StatusForbidden, "invalid_token", "download tokens only grant GET access")
+			return
+		}
+		key := strings.TrimPrefix(r.URL.Path, downloadPath)
+		bucketName := r.URL.Query().Get("bucket")
+		if bucketName == "" {
+			bucketName = bucket
+		}
+		claims, err := verifyToken(token)
+		if err != nil || claims.Key != key || claims.Bucket != bucketName || !servedKey(key) {
+			writeError(w, http.StatusForbidden, "invalid_token", "invalid or expired token")
+			return
+		}
+		next(w, r)
+	}
+}
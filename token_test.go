@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testKey = "0b5a3a4e-9d4f-4d7e-8f0a-2b6c1d3e4f50.png"
+
+func TestTokenHandlerIssuers(t *testing.T) {
+	defer func(secret, issuerSecret []byte, keys map[string]apiKey, name string) {
+		tokenSecret, tokenIssuerSecret, apiKeys, bucket = secret, issuerSecret, keys, name
+	}(tokenSecret, tokenIssuerSecret, apiKeys, bucket)
+	tokenSecret, bucket = []byte("secret"), "bucket"
+	tests := []struct {
+		name         string
+		issuerSecret string
+		apiKeys      map[string]apiKey
+		header       string
+		status       int
+	}{
+		{name: "no issuer", status: http.StatusForbidden},
+		{name: "missing issuer secret", issuerSecret: "operator", status: http.StatusUnauthorized},
+		{name: "wrong issuer secret", issuerSecret: "operator", header: "operat0r", status: http.StatusUnauthorized},
+		{name: "issuer secret", issuerSecret: "operator", header: "operator", status: http.StatusCreated},
+		{name: "API keys", apiKeys: map[string]apiKey{}, status: http.StatusCreated},
+	}
+	for _, test := range tests {
+		tokenIssuerSecret, apiKeys = []byte(test.issuerSecret), test.apiKeys
+		r := httptest.NewRequest(http.MethodPost, tokensPath, strings.NewReader(`{"key": "`+testKey+`"}`))
+		if test.header != "" {
+			r.Header.Set("X-Token-Issuer-Secret", test.header)
+		}
+		w := httptest.NewRecorder()
+		tokenHandler(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestTokenHandlerServedKeys(t *testing.T) {
+	defer func(secret []byte, keys map[string]apiKey, name string) {
+		tokenSecret, apiKeys, bucket = secret, keys, name
+	}(tokenSecret, apiKeys, bucket)
+	tokenSecret, apiKeys, bucket = []byte("secret"), map[string]apiKey{}, "bucket"
+	for _, key := range []string{"dedup/9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08", "uploads/" + testKey, "staging/" + testKey, "report.png"} {
+		w := httptest.NewRecorder()
+		tokenHandler(w, httptest.NewRequest(http.MethodPost, tokensPath, strings.NewReader(`{"key": "`+key+`"}`)))
+		checkErrorResponse(t, w, http.StatusBadRequest, "invalid_key")
+	}
+
+	w := httptest.NewRecorder()
+	tokenHandler(w, httptest.NewRequest(http.MethodPost, tokensPath, strings.NewReader(`{"key": "`+testKey+`", "bucket": "bucket"}`)))
+	var message TokenMessage
+	if err := json.NewDecoder(w.Body).Decode(&message); err != nil {
+		t.Fatal(err)
+	}
+	if want := downloadPath + testKey + "?token=" + message.Token; len(message.Links) != 1 || message.Links[0].URL != want {
+		t.Errorf("got links %+v, want %s", message.Links, want)
+	}
+}
+
+func TestAcceptToken(t *testing.T) {
+	defer func(secret []byte, keys map[string]apiKey, name string) {
+		tokenSecret, apiKeys, bucket = secret, keys, name
+	}(tokenSecret, apiKeys, bucket)
+	// The API keys reject every request without a token.
+	tokenSecret, apiKeys, bucket = []byte("secret"), map[string]apiKey{}, "bucket"
+	sign := func(bucket, key string, expiresAt time.Time) string {
+		token, err := signToken(tokenClaims{Bucket: bucket, Key: key, ExpiresAt: expiresAt.Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := sign("bucket", testKey, time.Now().Add(time.Hour))
+	const otherKey = "1c6b4b5f-0e50-4e8f-9f1b-3c7d2e4f5a61.png"
+	tests := []struct {
+		name   string
+		method string
+		target string
+		status int
+	}{
+		{name: "token", method: http.MethodGet, target: downloadPath + testKey + "?token=" + valid, status: http.StatusOK},
+		{name: "head", method: http.MethodHead, target: downloadPath + testKey + "?token=" + valid, status: http.StatusOK},
+		{name: "no token", method: http.MethodGet, target: downloadPath + testKey, status: http.StatusUnauthorized},
+		{name: "other key", method: http.MethodGet, target: downloadPath + otherKey + "?token=" + valid, status: http.StatusForbidden},
+		{name: "other bucket", method: http.MethodGet, target: downloadPath + testKey + "?bucket=other&token=" + valid, status: http.StatusForbidden},
+		{name: "delete", method: http.MethodDelete, target: downloadPath + testKey + "?token=" + valid, status: http.StatusForbidden},
+		{name: "expired", method: http.MethodGet, target: downloadPath + testKey + "?token=" + sign("bucket", testKey, time.Now().Add(-time.Second)), status: http.StatusForbidden},
+		{name: "forged", method: http.MethodGet, target: downloadPath + testKey + "?token=" + valid + "x", status: http.StatusForbidden},
+		{name: "internal key", method: http.MethodGet, target: downloadPath + "uploads/" + testKey + "?token=" + sign("bucket", "uploads/"+testKey, time.Now().Add(time.Hour)), status: http.StatusForbidden},
+	}
+	handler := acceptToken(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(test.method, test.target, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+var (
+	enableTranscode  bool
+	transcodeQuality = 85                // JPEG quality, from 1 to 100.
+	maxTranscodeSize = int64(50 << 20)   // Bodies are buffered in memory to be decoded.
+	maxDecodePixels  = int64(40_000_000) // Decoding allocates memory proportional to it.
+)
+
+var (
+	errTranscodeTooLarge = errors.New("image too large to transcode")
+	errUnsupportedFormat = errors.New("unsupported image format")
+)
+
+// transcodeFormats maps the X-Target-Format values to their content type.
+var transcodeFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+}
+
+// transcode decodes the image read from body and encodes it in the target format, returning
+// the encoded image and its content type. The image dimensions are checked before it is fully
+// decoded, so that small files decoding to huge images cannot exhaust memory.
+func transcode(body io.Reader, target string) ([]byte, string, error) {
+	contentType, ok := transcodeFormats[target]
+	if !ok {
+		return nil, "", fmt.Errorf("%w: target %q", errUnsupportedFormat, target)
+	}
+	data, err := io.ReadAll(io.LimitReader(body, maxTranscodeSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > maxTranscodeSize {
+		return nil, "", errTranscodeTooLarge
+	}
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errUnsupportedFormat, err)
+	}
+	if int64(config.Width)*int64(config.Height) > maxDecodePixels {
+		return nil, "", fmt.Errorf("%w: %dx%d %s", errTranscodeTooLarge, config.Width, config.Height, format)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %v", errUnsupportedFormat, err)
+	}
+	var buffer bytes.Buffer
+	switch target {
+	case "jpeg":
+		err = jpeg.Encode(&buffer, img, &jpeg.Options{Quality: transcodeQuality})
+	case "png":
+		err = png.Encode(&buffer, img)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buffer.Bytes(), contentType, nil
+}
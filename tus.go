@@ -0,0 +1,384 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	tusPath    = "/api/v1/tus"
+	tusVersion = "1.0.0"
+)
+
+// tusSessions are the sessions of the tus uploads, aborted by sweepSessions once they expire.
+var tusSessions = &sessionStore{sessions: make(map[string]session)}
+
+// tusHandler implements the core tus 1.0 resumable upload protocol, with its creation
+// extension, over multipart uploads:
+//
+//	OPTIONS /api/v1/tus      discovers the capabilities of the server.
+//	POST    /api/v1/tus      creates an upload of Upload-Length bytes.
+//	HEAD    /api/v1/tus/{id} returns the Upload-Offset stored so far.
+//	PATCH   /api/v1/tus/{id} appends the body at Upload-Offset.
+//
+// The upload is completed once Upload-Length bytes are stored.
+func tusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, tusPath), "/")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation")
+		w.Header().Set("Tus-Max-Size", strconv.FormatInt(maxContentSize, 10))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, http.StatusPreconditionFailed, "unsupported_version", "unsupported Tus-Resumable version")
+		return
+	}
+	switch {
+	case id == "" && r.Method == http.MethodPost:
+		createTusUpload(w, r)
+	case id != "" && !strings.Contains(id, "/") && r.Method == http.MethodHead:
+		// The IDs of the uploads of different API keys do not collide.
+		session, ok := tusSessions.get(keyPrefix(r) + id)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(session.Size, 10))
+		w.WriteHeader(http.StatusOK)
+	case id != "" && !strings.Contains(id, "/") && r.Method == http.MethodPatch:
+		patchTusUpload(w, r, keyPrefix(r)+id)
+	case id == "" || !strings.Contains(id, "/"):
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "not found")
+	}
+}
+
+// tusMetadata parses the Upload-Metadata header, comma separated keys each followed by its
+// base64 encoded value, if any.
+func tusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if key == "" || err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata %q", pair)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// tusObjectMetadata returns the user-defined metadata of the object of a tus upload: the default
+// metadata and the Upload-Metadata values but the content type, with lowercased keys. Values
+// that are not printable US-ASCII, such as the UTF-8 filenames Uppy sends, are RFC 2047 encoded,
+// as Amazon S3 returns them in headers.
+func tusObjectMetadata(metadata map[string]string) (map[string]string, error) {
+	objectMetadata := make(map[string]string, len(defaultMetadata)+len(metadata))
+	for key, value := range defaultMetadata {
+		objectMetadata[key] = value
+	}
+	for key, value := range metadata {
+		if key == "filetype" || key == "contentType" {
+			continue
+		}
+		objectMetadata[strings.ToLower(key)] = mime.QEncoding.Encode("utf-8", value)
+	}
+	if err := checkMetadata(objectMetadata); err != nil {
+		return nil, err
+	}
+	if len(objectMetadata) == 0 {
+		return nil, nil
+	}
+	return objectMetadata, nil
+}
+
+// createTusUpload starts the multipart upload of a tus upload, whose content type is the
+// "filetype" value of its Upload-Metadata, as tus-js-client and Uppy send it, or "contentType".
+// The other values are stored as the metadata of the object.
+func createTusUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		writeError(w, http.StatusBadRequest, "invalid_upload_length", "deferred lengths are not supported")
+		return
+	}
+	size, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 1 {
+		writeError(w, http.StatusBadRequest, "invalid_upload_length", "invalid Upload-Length")
+		return
+	}
+	if size > maxContentSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "entity_too_large", "upload too large")
+		return
+	}
+	// The PATCH requests count towards the quota, the creation is rejected up front when they
+	// could not all be received.
+	if key, ok := requestAPIKey(r); ok && key.DailyQuota > 0 && quotas.used(key.ID)+size > key.DailyQuota {
+		writeError(w, http.StatusTooManyRequests, "quota_exceeded", "daily upload quota exceeded")
+		return
+	}
+	metadata, err := tusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	objectMetadata, err := tusObjectMetadata(metadata)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	contentType := metadata["filetype"]
+	if contentType == "" {
+		contentType = metadata["contentType"]
+	}
+	contentType = normalizeContentType(contentType)
+	if !acceptedContentType(contentType, contentTypes["/api/v1/file"]) {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "unsupported content type")
+		return
+	}
+	encryption, err := requestEncryption(r)
+	if err != nil {
+		writeEncryptionError(w, err)
+		return
+	}
+	if rejectsVideo(contentType, encryption) {
+		writeError(w, http.StatusUnprocessableEntity, "poster_unavailable", "a poster cannot be extracted from the video")
+		return
+	}
+	lock, hints, tags, ok := requestRetention(w, r)
+	if !ok {
+		return
+	}
+	if writeShed(w) {
+		return
+	}
+	ctx := r.Context()
+	id := uuid.New().String()
+	session := session{
+		ID:             keyPrefix(r) + id,
+		Bucket:         resolveBucket(contentType),
+		Key:            keyPrefix(r) + newKey(contentType),
+		ExpiresAt:      time.Now().Add(sessionTTL),
+		ContentType:    contentType,
+		Metadata:       objectMetadata,
+		LifecycleHints: hints,
+		Tags:           tags,
+		Size:           size,
+	}
+	session.setEncryption(r, encryption)
+	multipartUploadOutput, err := storage.CreateUpload(ctx, newCreateMultipartUploadInput(session.Bucket, session.Key, contentType,
+		withEncryption(encryption),
+		withObjectLock(lock),
+		withStorageClass(defaultStorageClass),
+		withTags(hints, tags),
+		withMetadata(objectMetadata),
+	))
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	session.UploadID = *multipartUploadOutput.UploadId
+	tusSessions.put(session)
+	w.Header().Set("Location", tusPath+"/"+id)
+	w.Header().Set("X-Object-Key", session.Key)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patchTusUpload stores the body appended at Upload-Offset as the next parts of the multipart
+// upload. The body is split into parts of the part size, and a PATCH cut off before its end
+// keeps the parts stored so far, so that the client resumes from the Upload-Offset answered by
+// HEAD. As Amazon S3 requires every part but the last to hold at least 5 MB, so must every
+// PATCH but the last, and the bytes of a cut off PATCH past its last full part are dropped.
+func patchTusUpload(w http.ResponseWriter, r *http.Request, id string) {
+	if normalizeContentType(r.Header.Get("Content-Type")) != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "PATCH requests must be application/offset+octet-stream")
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_upload_offset", "invalid Upload-Offset")
+		return
+	}
+	session, ok, err := tusSessions.acquire(id)
+	if errors.Is(err, errSessionBusy) {
+		writeError(w, http.StatusConflict, "session_busy", "another PATCH of the upload is being received")
+		return
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "no such upload")
+		return
+	}
+	defer func() {
+		if _, ok := tusSessions.get(id); ok {
+			tusSessions.release(session)
+		}
+	}()
+	encryption, err := sessionEncryption(r, session)
+	if err != nil {
+		writeEncryptionError(w, err)
+		return
+	}
+	if offset != session.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+		writeError(w, http.StatusConflict, "invalid_upload_offset", "Upload-Offset does not match the stored bytes")
+		return
+	}
+	remaining := session.Size - session.Offset
+	if r.ContentLength > remaining {
+		writeError(w, http.StatusBadRequest, "entity_too_large", "the body exceeds Upload-Length")
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength < remaining && r.ContentLength < minUploadPartSize {
+		writeError(w, http.StatusBadRequest, "chunk_too_small", "every PATCH but the last must be at least 5 MB")
+		return
+	}
+	ctx := r.Context()
+	var body io.Reader = io.LimitReader(r.Body, remaining)
+	// The first bytes must look like the declared type, the sniffed bytes are still uploaded.
+	if session.Offset == 0 {
+		var sniffed string
+		sniffed, body, err = sniffBody(body)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		if !matchesSniffed(session.ContentType, sniffed, contentTypes["/api/v1/file"]) {
+			logEntry(r.Context(), logLevelInfo, "content type mismatch", "declared", session.ContentType, "sniffed", sniffed)
+			writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "contents do not match the content type")
+			return
+		}
+	}
+	session.ExpiresAt = time.Now().Add(sessionTTL)
+	deadline := withDeadline(throttle(ctx, body))
+	partSize := partSizeFor(session.Size, partSize)
+	partReader, err := newPartReader(partReaderStrategy, deadline, partSize)
+	if err != nil && !errors.Is(err, errUploadDuration) {
+		writeS3Error(w, r, err)
+		return
+	}
+	if partReader != nil {
+		defer partReader.Close()
+	}
+	for err == nil && session.Offset < session.Size {
+		var part Part
+		part, err = partReader.NextPart()
+		if err != nil {
+			break
+		}
+		final := session.Offset+part.Size == session.Size
+		if part.Size == 0 || (part.Size < partSize && !final && part.Size < minUploadPartSize) {
+			part.Release()
+			break
+		}
+		if len(session.Parts) == maxPartNumber {
+			part.Release()
+			writeError(w, http.StatusRequestEntityTooLarge, "entity_too_large", "too many parts")
+			return
+		}
+		var partMD5 string
+		partMD5, err = contentMD5(part.Body)
+		if err != nil {
+			part.Release()
+			break
+		}
+		partNumber := int32(len(session.Parts) + 1)
+		var uploadPartOutput *s3.UploadPartOutput
+		uploadPartOutput, err = uploadPartWithRetries(ctx, &s3.UploadPartInput{
+			Bucket:               aws.String(session.Bucket),
+			Key:                  aws.String(session.Key),
+			PartNumber:           partNumber,
+			UploadId:             aws.String(session.UploadID),
+			Body:                 part.Body,
+			ContentLength:        part.Size,
+			ContentMD5:           aws.String(partMD5),
+			SSECustomerAlgorithm: encryption.customerAlgorithm,
+			SSECustomerKey:       encryption.customerKey,
+			SSECustomerKeyMD5:    encryption.customerKeyMD5,
+		})
+		part.Release()
+		if err != nil {
+			break
+		}
+		session.Parts = append(session.Parts, types.CompletedPart{
+			ETag:       uploadPartOutput.ETag,
+			PartNumber: partNumber,
+		})
+		session.Offset += part.Size
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	if errors.Is(err, errUploadDuration) {
+		logEntry(r.Context(), logLevelInfo, "upload cut off", "error", err, "bytes", deadline.n)
+		writeUploadDuration(w)
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if session.Offset < session.Size {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	completeMultipartUploadOutput, err := storage.Complete(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(session.Bucket),
+		Key:      aws.String(session.Key),
+		UploadId: aws.String(session.UploadID),
+		MultipartUpload: &types.CompletedMultipartUpload{
+			Parts: session.Parts,
+		},
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	tusSessions.delete(id)
+	recentUploads.add(session.Bucket, session.Key)
+	links := []Link{
+		{
+			URL: objectURL(ctx, session.Bucket, session.Key, *completeMultipartUploadOutput.Location),
+		},
+	}
+	poster, err := attachPoster(ctx, session.Bucket, session.Key, *completeMultipartUploadOutput.Location, session.ContentType, encryption)
+	if err != nil {
+		writePosterError(w, r, err)
+		return
+	}
+	if poster != nil {
+		links = append(links, *poster)
+	}
+	links = append(links, notifyUploaded(webhookURL, Notification{
+		Bucket:      session.Bucket,
+		Key:         session.Key,
+		ContentType: session.ContentType,
+		Size:        session.Size,
+		Metadata:    session.Metadata,
+		Links:       links,
+	})...)
+	// tus answers the last PATCH without a body, so the links are sent as a Link header.
+	for _, link := range links {
+		w.Header().Add("Link", linkHeader(link))
+	}
+	w.Header().Set("X-Object-Key", session.Key)
+	w.WriteHeader(http.StatusNoContent)
+}
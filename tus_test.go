@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTusMetadata(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{header: "", want: map[string]string{}},
+		{header: "  ", want: map[string]string{}},
+		{header: "filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==", want: map[string]string{"filename": "world_domination_plan.pdf"}},
+		{header: "filetype aW1hZ2UvcG5n,is_confidential", want: map[string]string{"filetype": "image/png", "is_confidential": ""}},
+		{header: "filetype aW1hZ2UvcG5n, name YS5wbmc=", want: map[string]string{"filetype": "image/png", "name": "a.png"}},
+		{header: "filename not-base64!", wantErr: true},
+		{header: "filetype aW1hZ2UvcG5n,", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := tusMetadata(test.header)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("tusMetadata(%q) = %v, want an error", test.header, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tusMetadata(%q): %v", test.header, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("tusMetadata(%q) = %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestTusObjectMetadata(t *testing.T) {
+	defer func(metadata map[string]string) { defaultMetadata = metadata }(defaultMetadata)
+	defaultMetadata = map[string]string{"service": "uploads"}
+
+	got, err := tusObjectMetadata(map[string]string{
+		"filetype": "image/png",
+		"Filename": "café.png",
+		"Album":    "holidays",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"service":  "uploads",
+		"filename": "=?utf-8?q?caf=C3=A9.png?=",
+		"album":    "holidays",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	defaultMetadata = nil
+	got, err = tusObjectMetadata(map[string]string{"contentType": "image/png"})
+	if err != nil || got != nil {
+		t.Errorf("got %v and %v for no metadata, want none", got, err)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"net/http"
+)
+
+// uploadOption sets the fields of a CreateMultipartUploadInput that a feature controls.
+type uploadOption func(input *s3.CreateMultipartUploadInput)
+
+// newCreateMultipartUploadInput returns the input of a private multipart upload with the options
+// applied in order.
+func newCreateMultipartUploadInput(bucket, key, contentType string, options ...uploadOption) *s3.CreateMultipartUploadInput {
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		ACL:         types.ObjectCannedACLPrivate,
+		ContentType: aws.String(contentType),
+	}
+	for _, option := range options {
+		option(input)
+	}
+	return input
+}
+
+func withEncryption(encryption encryption) uploadOption {
+	return func(input *s3.CreateMultipartUploadInput) {
+		input.ServerSideEncryption = encryption.serverSideEncryption
+		input.SSEKMSKeyId = encryption.kmsKeyID
+		input.SSEKMSEncryptionContext = encryption.kmsContext
+		input.SSECustomerAlgorithm = encryption.customerAlgorithm
+		input.SSECustomerKey = encryption.customerKey
+		input.SSECustomerKeyMD5 = encryption.customerKeyMD5
+	}
+}
+
+// withChecksumSHA256 makes Amazon S3 expect the SHA-256 of every part when enabled.
+func withChecksumSHA256(enabled bool) uploadOption {
+	return func(input *s3.CreateMultipartUploadInput) {
+		if enabled {
+			input.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+		}
+	}
+}
+
+// withStorageClass stores the object in the storage class, STANDARD when it is empty.
+func withStorageClass(class types.StorageClass) uploadOption {
+	return func(input *s3.CreateMultipartUploadInput) {
+		input.StorageClass = class
+	}
+}
+
+func withObjectLock(lock objectLock) uploadOption {
+	return func(input *s3.CreateMultipartUploadInput) {
+		input.ObjectLockMode = lock.mode
+		input.ObjectLockRetainUntilDate = lock.retainUntil
+	}
+}
+
+// withTags sets the tags of the object, merged from every tag set, none when they are empty.
+func withTags(tagSets ...map[string]string) uploadOption {
+	return func(input *s3.CreateMultipartUploadInput) {
+		tags := make(map[string]string)
+		for _, set := range tagSets {
+			for key, value := range set {
+				tags[key] = value
+			}
+		}
+		input.Tagging = tagging(tags)
+	}
+}
+
+// withMetadata sets the user-defined metadata of the object, none when metadata is empty.
+func withMetadata(metadata map[string]string) uploadOption {
+	return func(input *s3.CreateMultipartUploadInput) {
+		input.Metadata = metadata
+	}
+}
+
+// requestRetention returns the object lock of the X-Amz-Object-Lock-* headers, and the lifecycle
+// hints and tags of the X-Lifecycle-Hints and X-Object-Tagging headers, with their defaults, that
+// every upload stores its object with. Invalid headers are answered and return false.
+func requestRetention(w http.ResponseWriter, r *http.Request) (objectLock, map[string]string, map[string]string, bool) {
+	hints, err := lifecycleHints(r.Header.Get("X-Lifecycle-Hints"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_lifecycle_hints", err.Error())
+		return objectLock{}, nil, nil, false
+	}
+	tags, err := objectTags(r.Header.Get("X-Object-Tagging"), hints)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_tagging", err.Error())
+		return objectLock{}, nil, nil, false
+	}
+	lock, err := requestObjectLock(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_object_lock", err.Error())
+		return objectLock{}, nil, nil, false
+	}
+	return lock, hints, tags, true
+}
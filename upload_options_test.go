@@ -0,0 +1,121 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewCreateMultipartUploadInput(t *testing.T) {
+	input := newCreateMultipartUploadInput("bucket", "a.png", "image/png")
+	if aws.ToString(input.Bucket) != "bucket" || aws.ToString(input.Key) != "a.png" || aws.ToString(input.ContentType) != "image/png" || input.ACL != types.ObjectCannedACLPrivate {
+		t.Errorf("got %+v", input)
+	}
+	input = newCreateMultipartUploadInput("bucket", "a.png", "image/png", withStorageClass(types.StorageClassGlacierIr), withStorageClass(types.StorageClassStandardIa))
+	if input.StorageClass != types.StorageClassStandardIa {
+		t.Errorf("got storage class %q, want the last option applied", input.StorageClass)
+	}
+}
+
+func TestUploadOptions(t *testing.T) {
+	retainUntil := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		option uploadOption
+		want   s3.CreateMultipartUploadInput
+	}{
+		{
+			name: "KMS encryption",
+			option: withEncryption(encryption{
+				serverSideEncryption: types.ServerSideEncryptionAwsKms,
+				kmsKeyID:             aws.String("alias/uploads"),
+				kmsContext:           aws.String("eyJzZXJ2aWNlIjoidXBsb2FkcyJ9"),
+			}),
+			want: s3.CreateMultipartUploadInput{
+				ServerSideEncryption:    types.ServerSideEncryptionAwsKms,
+				SSEKMSKeyId:             aws.String("alias/uploads"),
+				SSEKMSEncryptionContext: aws.String("eyJzZXJ2aWNlIjoidXBsb2FkcyJ9"),
+			},
+		},
+		{
+			name: "customer encryption",
+			option: withEncryption(encryption{
+				customerAlgorithm: aws.String("AES256"),
+				customerKey:       aws.String(testCustomerKey),
+				customerKeyMD5:    aws.String("md5"),
+			}),
+			want: s3.CreateMultipartUploadInput{
+				SSECustomerAlgorithm: aws.String("AES256"),
+				SSECustomerKey:       aws.String(testCustomerKey),
+				SSECustomerKeyMD5:    aws.String("md5"),
+			},
+		},
+		{name: "checksum", option: withChecksumSHA256(true), want: s3.CreateMultipartUploadInput{ChecksumAlgorithm: types.ChecksumAlgorithmSha256}},
+		{name: "no checksum", option: withChecksumSHA256(false)},
+		{name: "storage class", option: withStorageClass(types.StorageClassIntelligentTiering), want: s3.CreateMultipartUploadInput{StorageClass: types.StorageClassIntelligentTiering}},
+		{
+			name:   "object lock",
+			option: withObjectLock(objectLock{mode: types.ObjectLockModeGovernance, retainUntil: &retainUntil}),
+			want:   s3.CreateMultipartUploadInput{ObjectLockMode: types.ObjectLockModeGovernance, ObjectLockRetainUntilDate: &retainUntil},
+		},
+		{
+			name:   "tags",
+			option: withTags(map[string]string{"a": "1", "b": "1"}, map[string]string{"b": "2"}),
+			want:   s3.CreateMultipartUploadInput{Tagging: aws.String("a=1&b=2")},
+		},
+		{name: "no tags", option: withTags(nil, map[string]string{})},
+		{
+			name:   "metadata",
+			option: withMetadata(map[string]string{"album": "holidays"}),
+			want:   s3.CreateMultipartUploadInput{Metadata: map[string]string{"album": "holidays"}},
+		},
+	}
+	for _, test := range tests {
+		var input s3.CreateMultipartUploadInput
+		test.option(&input)
+		if !reflect.DeepEqual(input, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, input, test.want)
+		}
+	}
+}
+
+func TestRequestRetention(t *testing.T) {
+	defer func(mode types.ObjectLockMode, duration time.Duration, hints map[string]string) {
+		defaultObjectLockMode, defaultRetentionDuration, defaultLifecycleHints = mode, duration, hints
+	}(defaultObjectLockMode, defaultRetentionDuration, defaultLifecycleHints)
+	defaultObjectLockMode, defaultRetentionDuration = types.ObjectLockModeGovernance, 24*time.Hour
+	defaultLifecycleHints = map[string]string{"tier": "standard"}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/uploads", nil)
+	r.Header.Set("X-Object-Tagging", "user=42")
+	lock, hints, tags, ok := requestRetention(httptest.NewRecorder(), r)
+	if !ok {
+		t.Fatal("the headers were rejected")
+	}
+	if lock.mode != types.ObjectLockModeGovernance || lock.retainUntil == nil || time.Until(*lock.retainUntil) < 23*time.Hour {
+		t.Errorf("got object lock %+v, want the default retention", lock)
+	}
+	if !reflect.DeepEqual(hints, map[string]string{"tier": "standard"}) || !reflect.DeepEqual(tags, map[string]string{"user": "42"}) {
+		t.Errorf("got hints %v and tags %v", hints, tags)
+	}
+
+	for header, code := range map[string]string{
+		"X-Lifecycle-Hints":      "invalid_lifecycle_hints",
+		"X-Object-Tagging":       "invalid_tagging",
+		"X-Amz-Object-Lock-Mode": "invalid_object_lock",
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/uploads", nil)
+		r.Header.Set(header, "%invalid")
+		w := httptest.NewRecorder()
+		if _, _, _, ok := requestRetention(w, r); ok {
+			t.Errorf("invalid %s was accepted", header)
+			continue
+		}
+		checkErrorResponse(t, w, http.StatusBadRequest, code)
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"hash"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// uploadConcurrency is the number of UploadPart calls of an upload running at the same time.
+// As many parts may wait for a free worker, an upload buffers up to twice as many parts, plus
+// the one being read.
+var uploadConcurrency = 4
+
+// Failed UploadPart calls are retried up to maxPartRetries times, with exponential backoff and
+// jitter, when the configured retryables classify their error as transient.
+var (
+	maxPartRetries   = 3
+	partRetryBackoff = 200 * time.Millisecond
+)
+
+// partChecksumSHA256 uploads the parts of single request uploads with their SHA-256 too, which
+// Amazon S3 verifies and combines into the checksum of the completed object.
+var partChecksumSHA256 bool
+
+var (
+	errTooManyParts     = errors.New("too many parts")
+	errChecksumMismatch = errors.New("checksum of the completed object does not match its parts")
+)
+
+// uploadParts reads the parts sequentially and uploads them with uploadConcurrency workers,
+// returning the completed parts in ascending part number order and their total size. Each
+// stored part is reported to progress. The first failure cancels the uploads in flight and is
+// returned, as is the error of ctx when it is done before every part was uploaded.
+func uploadParts(ctx context.Context, partReader PartReader, output *s3.CreateMultipartUploadOutput, encryption encryption, expected int, progress *uploadProgress) ([]types.CompletedPart, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu             sync.Mutex
+		completedParts = make([]types.CompletedPart, 0, expected)
+		firstErr       error
+	)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+	parts := make(chan Part, uploadConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < uploadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range parts {
+				partQueueLength.Dec()
+				if ctx.Err() != nil {
+					part.Release()
+					fail(ctx.Err())
+					continue
+				}
+				completedPart, err := uploadPart(ctx, output, part, encryption)
+				size := part.Size
+				part.Release()
+				if err != nil {
+					fail(err)
+					continue
+				}
+				progress.partUploaded(size)
+				mu.Lock()
+				completedParts = append(completedParts, completedPart)
+				mu.Unlock()
+			}
+		}()
+	}
+	var size int64
+	lastPart := false
+	for !lastPart && ctx.Err() == nil {
+		readStart := time.Now()
+		part, err := partReader.NextPart()
+		bodyReadSeconds.Add(time.Since(readStart).Seconds())
+		if err != nil {
+			fail(err)
+			break
+		}
+		lastPart = part.Last
+		if part.Number > maxPartNumber {
+			part.Release()
+			fail(errTooManyParts)
+			break
+		}
+		size += part.Size
+		partQueueLength.Inc()
+		select {
+		case parts <- part:
+		case <-ctx.Done():
+			partQueueLength.Dec()
+			part.Release()
+			fail(ctx.Err())
+		}
+	}
+	if !lastPart {
+		fail(ctx.Err())
+	}
+	close(parts)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+	if err := sortCompletedParts(completedParts); err != nil {
+		return nil, 0, err
+	}
+	return completedParts, size, nil
+}
+
+func uploadPart(ctx context.Context, output *s3.CreateMultipartUploadOutput, part Part, encryption encryption) (types.CompletedPart, error) {
+	partMD5, err := contentMD5(part.Body)
+	if err != nil {
+		return types.CompletedPart{}, err
+	}
+	var partSHA256 *string
+	if partChecksumSHA256 {
+		sum, err := checksum(part.Body, sha256.New())
+		if err != nil {
+			return types.CompletedPart{}, err
+		}
+		partSHA256 = aws.String(sum)
+	}
+	uploadStart := time.Now()
+	uploadPartOutput, err := uploadPartWithRetries(ctx, &s3.UploadPartInput{
+		Bucket:               output.Bucket,
+		Key:                  output.Key,
+		PartNumber:           part.Number,
+		UploadId:             output.UploadId,
+		Body:                 part.Body,
+		ContentLength:        part.Size,
+		ContentMD5:           aws.String(partMD5),
+		ChecksumSHA256:       partSHA256,
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	partUploadSeconds.Add(time.Since(uploadStart).Seconds())
+	if err != nil {
+		return types.CompletedPart{}, err
+	}
+	return types.CompletedPart{
+		ETag:           uploadPartOutput.ETag,
+		PartNumber:     part.Number,
+		ChecksumSHA256: uploadPartOutput.ChecksumSHA256,
+	}, nil
+}
+
+// contentMD5 returns the base64 encoded MD5 of body and rewinds it. Parts are uploaded with it,
+// so that Amazon S3 rejects them with BadDigest when they are corrupted in transit. It is also
+// required on every part of an object with a retention period.
+func contentMD5(body io.ReadSeeker) (string, error) {
+	return checksum(body, md5.New())
+}
+
+// checksum returns the base64 encoded hash of body and rewinds it.
+func checksum(body io.ReadSeeker, hash hash.Hash) (string, error) {
+	if _, err := io.Copy(hash, body); err != nil {
+		return "", err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(hash.Sum(nil)), nil
+}
+
+// compositeChecksum returns the checksum Amazon S3 computes for a multipart upload from the
+// SHA-256 of its parts: the SHA-256 of their concatenation, followed by the number of parts.
+func compositeChecksum(parts []types.CompletedPart) (string, error) {
+	hash := sha256.New()
+	for _, part := range parts {
+		sum, err := base64.StdEncoding.DecodeString(aws.ToString(part.ChecksumSHA256))
+		if err != nil {
+			return "", err
+		}
+		hash.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", base64.StdEncoding.EncodeToString(hash.Sum(nil)), len(parts)), nil
+}
+
+// verifyCompositeChecksum compares the checksum of the completed object with the one of its
+// parts, and deletes the object when they differ.
+func verifyCompositeChecksum(ctx context.Context, output *s3.CompleteMultipartUploadOutput, parts []types.CompletedPart) error {
+	expected, err := compositeChecksum(parts)
+	if err != nil {
+		return err
+	}
+	if output.ChecksumSHA256 == nil {
+		log.Printf("no checksum returned for %s, not verified", aws.ToString(output.Key))
+		return nil
+	}
+	if *output.ChecksumSHA256 == expected {
+		return nil
+	}
+	log.Printf("checksum %s of %s does not match %s of its parts", *output.ChecksumSHA256, aws.ToString(output.Key), expected)
+	if _, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket:    output.Bucket,
+		Key:       output.Key,
+		VersionId: output.VersionId,
+	}); err != nil {
+		log.Print(err)
+	}
+	return errChecksumMismatch
+}
+
+// uploadPartWithRetries calls UploadPart, rewinding the body before each retry. The storage does
+// not retry the call, as the retry quota of the AWS SDK, shared by every call of the client,
+// would stop retrying the parts of large uploads. Cancelling ctx stops the retries.
+func uploadPartWithRetries(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	retryable := retryables()
+	backoff := partRetryBackoff
+	for attempt := 0; ; attempt++ {
+		attemptStart := time.Now()
+		output, err := storage.UploadPart(ctx, input)
+		health.observe(err, time.Since(attemptStart))
+		logEntry(ctx, logLevelDebug, "part uploaded",
+			"uploadId", aws.ToString(input.UploadId),
+			"partNumber", input.PartNumber,
+			"size", input.ContentLength,
+			"attempt", attempt+1,
+			"durationMs", time.Since(attemptStart).Milliseconds(),
+			"error", err,
+		)
+		if err != nil && attempt > 0 && attempt == maxPartRetries {
+			return nil, fmt.Errorf("part %d of upload %s failed after %d attempts: %w", input.PartNumber, aws.ToString(input.UploadId), attempt+1, err)
+		}
+		if err == nil || attempt == maxPartRetries || ctx.Err() != nil || retryable.IsErrorRetryable(err) != aws.TrueTernary {
+			return output, err
+		}
+		seeker, ok := input.Body.(io.Seeker)
+		if !ok {
+			return nil, err
+		}
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		logEntry(ctx, logLevelInfo, "retrying part",
+			"uploadId", aws.ToString(input.UploadId),
+			"partNumber", input.PartNumber,
+			"error", err,
+		)
+		timer := time.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
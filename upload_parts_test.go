@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+	"strings"
+	"testing"
+	"time"
+)
+
+// delayedStorage answers UploadPart after the delay of the part number, or once ctx is done.
+type delayedStorage struct {
+	Storage
+	delay func(partNumber int32) time.Duration
+}
+
+func (s delayedStorage) UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	select {
+	case <-time.After(s.delay(input.PartNumber)):
+		return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf(`"%d"`, input.PartNumber))}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// cancelingPartReader cancels its context before answering the part numbered at, and never
+// answers a last part.
+type cancelingPartReader struct {
+	cancel context.CancelFunc
+	at     int32
+	number int32
+}
+
+func (r *cancelingPartReader) NextPart() (Part, error) {
+	r.number++
+	if r.number == r.at {
+		r.cancel()
+	}
+	return Part{Number: r.number, Body: bytes.NewReader([]byte("part")), Size: 4}, nil
+}
+
+func (r *cancelingPartReader) Close() error {
+	return nil
+}
+
+var testUpload = &s3.CreateMultipartUploadOutput{
+	Bucket:   aws.String("bucket"),
+	Key:      aws.String("key"),
+	UploadId: aws.String("upload"),
+}
+
+func TestUploadPartsOrder(t *testing.T) {
+	defer func(s Storage) { storage = s }(storage)
+	const parts = 12
+	// The first parts are the slowest, so that they complete last.
+	storage = delayedStorage{delay: func(partNumber int32) time.Duration {
+		return time.Duration(parts-partNumber) * 2 * time.Millisecond
+	}}
+	body := strings.Repeat("x", parts*10-5)
+	partReader, err := newPartReader(partReaderMemory, strings.NewReader(body), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	completedParts, size, err := uploadParts(context.Background(), partReader, testUpload, encryption{}, parts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(body)) {
+		t.Errorf("got size %d, want %d", size, len(body))
+	}
+	if len(completedParts) != parts {
+		t.Fatalf("got %d parts, want %d", len(completedParts), parts)
+	}
+	for i, part := range completedParts {
+		if want := int32(i + 1); part.PartNumber != want || aws.ToString(part.ETag) != fmt.Sprintf(`"%d"`, want) {
+			t.Errorf("part %d: got number %d and ETag %s", i, part.PartNumber, aws.ToString(part.ETag))
+		}
+	}
+}
+
+func TestUploadPartsCanceled(t *testing.T) {
+	defer func(s Storage) { storage = s }(storage)
+	storage = delayedStorage{delay: func(int32) time.Duration { return 0 }}
+	for _, at := range []int32{1, 2, 3, 4, 5, 6, 10} {
+		ctx, cancel := context.WithCancel(context.Background())
+		completedParts, _, err := uploadParts(ctx, &cancelingPartReader{cancel: cancel, at: at}, testUpload, encryption{}, 0, nil)
+		cancel()
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("canceled at part %d: got %d parts and err %v, want %v", at, len(completedParts), err, context.Canceled)
+		}
+	}
+}
+
+// flakyStorage fails the first UploadPart calls with err, and counts the calls.
+type flakyStorage struct {
+	Storage
+	failures int
+	err      error
+	calls    int
+}
+
+func (s *flakyStorage) UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	s.calls++
+	if s.calls <= s.failures {
+		return nil, s.err
+	}
+	return &s3.UploadPartOutput{ETag: aws.String(`"etag"`)}, nil
+}
+
+func TestUploadPartRetries(t *testing.T) {
+	defer func(s Storage, retries int, backoff time.Duration) {
+		storage, maxPartRetries, partRetryBackoff = s, retries, backoff
+	}(storage, maxPartRetries, partRetryBackoff)
+	maxPartRetries, partRetryBackoff = 3, time.Millisecond
+	slowDown := &smithy.GenericAPIError{Code: "SlowDown", Message: "reduce your request rate"}
+	tests := []struct {
+		name      string
+		failures  int
+		err       error
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "retryable failures", failures: 2, err: slowDown, wantCalls: 3},
+		{name: "too many retryable failures", failures: 4, err: slowDown, wantCalls: 4, wantErr: true},
+		{name: "permanent failure", failures: 1, err: &smithy.GenericAPIError{Code: "AccessDenied"}, wantCalls: 1, wantErr: true},
+	}
+	for _, test := range tests {
+		s := &flakyStorage{failures: test.failures, err: test.err}
+		storage = s
+		partReader, err := newPartReader(partReaderMemory, strings.NewReader("part"), 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		completedParts, _, err := uploadParts(context.Background(), partReader, testUpload, encryption{}, 1, nil)
+		if s.calls != test.wantCalls {
+			t.Errorf("%s: got %d calls, want %d", test.name, s.calls, test.wantCalls)
+		}
+		if test.wantErr {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: got err %v, want %v", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(completedParts) != 1 || completedParts[0].PartNumber != 1 || aws.ToString(completedParts[0].ETag) != `"etag"` {
+			t.Errorf("%s: got parts %+v, want part 1 recorded", test.name, completedParts)
+		}
+	}
+}
+
+func TestUploadPartRetriesCanceled(t *testing.T) {
+	defer func(s Storage, backoff time.Duration) { storage, partRetryBackoff = s, backoff }(storage, partRetryBackoff)
+	partRetryBackoff = time.Hour
+	storage = &flakyStorage{failures: 1, err: &smithy.GenericAPIError{Code: "SlowDown"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := uploadPartWithRetries(ctx, &s3.UploadPartInput{PartNumber: 1, Body: strings.NewReader("part")})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got err %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned after %s, want once ctx is done", elapsed)
+	}
+}
+
+// recordingStorage records the inputs of UploadPart.
+type recordingStorage struct {
+	Storage
+	inputs []*s3.UploadPartInput
+}
+
+func (s *recordingStorage) UploadPart(ctx context.Context, input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	s.inputs = append(s.inputs, input)
+	return &s3.UploadPartOutput{ETag: aws.String(`"etag"`)}, nil
+}
+
+func TestContentMD5(t *testing.T) {
+	tests := []struct {
+		payload string
+		want    string
+	}{
+		{payload: "", want: "1B2M2Y8AsgTpgAmY7PhCfg=="},
+		{payload: "The quick brown fox jumps over the lazy dog", want: "nhB9nTcrtoJr2B01QqQZ1g=="},
+	}
+	for _, test := range tests {
+		body := strings.NewReader(test.payload)
+		got, err := contentMD5(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != test.want {
+			t.Errorf("contentMD5(%q) = %s, want %s", test.payload, got, test.want)
+		}
+		if body.Len() != len(test.payload) {
+			t.Errorf("contentMD5(%q) did not rewind the body", test.payload)
+		}
+	}
+
+	defer func(s Storage) { storage = s }(storage)
+	s := &recordingStorage{}
+	storage = s
+	part := Part{Number: 1, Body: strings.NewReader(tests[1].payload), Size: int64(len(tests[1].payload))}
+	if _, err := uploadPart(context.Background(), testUpload, part, encryption{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.inputs) != 1 || aws.ToString(s.inputs[0].ContentMD5) != tests[1].want {
+		t.Errorf("uploaded the part with %+v, want Content-MD5 %s", s.inputs, tests[1].want)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"io"
+	"path"
+	"time"
+)
+
+// Upload store backends selectable through UPLOAD_STORE.
+const (
+	uploadStoreMemory = "memory"
+	uploadStoreS3     = "s3"
+)
+
+// UploadStore keeps the sessions of resumable uploads between their requests. Expired sessions
+// are never returned.
+type UploadStore interface {
+	Get(ctx context.Context, id string) (session, bool, error)
+	Put(ctx context.Context, session session) error
+	Delete(ctx context.Context, id string) error
+}
+
+var uploadStore UploadStore = &memoryUploadStore{resumableSessions}
+
+// resumableSessions are the sessions of the memory upload store, aborted by sweepSessions once
+// they expire.
+var resumableSessions = &sessionStore{sessions: make(map[string]session)}
+
+// memoryUploadStore is an UploadStore local to the process.
+type memoryUploadStore struct {
+	sessions *sessionStore
+}
+
+func (s *memoryUploadStore) Get(_ context.Context, id string) (session, bool, error) {
+	session, ok := s.sessions.get(id)
+	if !ok || session.ExpiresAt.Before(time.Now()) {
+		return session, false, nil
+	}
+	return session, true, nil
+}
+
+func (s *memoryUploadStore) Put(_ context.Context, session session) error {
+	s.sessions.put(session)
+	return nil
+}
+
+func (s *memoryUploadStore) Delete(_ context.Context, id string) error {
+	s.sessions.delete(id)
+	return nil
+}
+
+// s3UploadStore is an UploadStore shared by every instance, which survives restarts, storing
+// one JSON object per session under a prefix of a bucket. The multipart uploads of sessions
+// that expire are left to ORPHANED_UPLOAD_TTL.
+type s3UploadStore struct {
+	bucket string
+	prefix string
+}
+
+func (s *s3UploadStore) Get(ctx context.Context, id string) (session, bool, error) {
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, id)),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return session{}, false, nil
+	} else if err != nil {
+		return session{}, false, err
+	}
+	defer output.Body.Close()
+	// Sessions hold up to 2 KB of metadata, which JSON may escape.
+	var stored session
+	if err := json.NewDecoder(io.LimitReader(output.Body, 16384)).Decode(&stored); err != nil {
+		return session{}, false, err
+	}
+	if stored.ExpiresAt.Before(time.Now()) {
+		return session{}, false, nil
+	}
+	return stored, true, nil
+}
+
+func (s *s3UploadStore) Put(ctx context.Context, session session) error {
+	body, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(path.Join(s.prefix, session.ID)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+func (s *s3UploadStore) Delete(ctx context.Context, id string) error {
+	_, err := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(path.Join(s.prefix, id)),
+	})
+	return err
+}
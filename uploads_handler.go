@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const uploadsPath = "/api/v1/uploads"
+
+type UploadRequest struct {
+	ContentType string `json:"contentType"`
+}
+
+// uploadsHandler serves the resumable uploads, whose parts are sent through the server in any
+// order and may be sent again until the upload is completed:
+//
+//	POST /api/v1/uploads                starts an upload.
+//	PUT  /api/v1/uploads/{id}/parts/{n} uploads part n.
+//	GET  /api/v1/uploads/{id}           returns the parts Amazon S3 has confirmed so far.
+//	POST /api/v1/uploads/{id}/complete  completes the multipart upload.
+//
+// GET /api/v1/uploads/{id}/progress reports the progress of the POST /api/v1/file upload sent
+// with the X-Upload-Id {id} instead.
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, uploadsPath), "/"), "/")
+	id := segments[0]
+	switch {
+	case id == "" && len(segments) == 1 && r.Method == http.MethodPost:
+		createUpload(w, r)
+	case id != "" && len(segments) == 1 && r.Method == http.MethodGet:
+		withUpload(w, r, id, func(session session) {
+			writeSessionStatus(w, r, uploadsPath, session)
+		})
+	case id != "" && len(segments) == 2 && segments[1] == "complete" && r.Method == http.MethodPost:
+		withUpload(w, r, id, func(session session) {
+			completeParts(w, r, session, func() error {
+				return uploadStore.Delete(r.Context(), session.ID)
+			})
+		})
+	case id != "" && len(segments) == 2 && segments[1] == "progress" && r.Method == http.MethodGet:
+		writeProgress(w, r, id)
+	case id != "" && len(segments) == 3 && segments[1] == "parts" && r.Method == http.MethodPut:
+		partNumber, err := strconv.ParseInt(segments[2], 10, 32)
+		if err != nil || partNumber < 1 || partNumber > maxPartNumber {
+			writeError(w, http.StatusBadRequest, "invalid_part_number", "part numbers must be between 1 and 10000")
+			return
+		}
+		withUpload(w, r, id, func(session session) {
+			putUploadPart(w, r, session, int32(partNumber))
+		})
+	case len(segments) == 1 || segments[1] == "complete" || segments[1] == "parts" || segments[1] == "progress":
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "not found")
+	}
+}
+
+// withUpload calls handle with the session of the upload, if it exists.
+func withUpload(w http.ResponseWriter, r *http.Request, id string, handle func(session session)) {
+	session, ok, err := uploadStore.Get(r.Context(), id)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	if !ok || !ownsKey(r, session.Key) {
+		writeError(w, http.StatusNotFound, "not_found", "no such upload")
+		return
+	}
+	handle(session)
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	if writeShed(w) {
+		return
+	}
+	var request UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", "invalid JSON body")
+		return
+	}
+	request.ContentType = normalizeContentType(request.ContentType)
+	if !acceptedContentType(request.ContentType, contentTypes["/api/v1/file"]) {
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "unsupported content type")
+		return
+	}
+	encryption, err := requestEncryption(r)
+	if err != nil {
+		writeEncryptionError(w, err)
+		return
+	}
+	if rejectsVideo(request.ContentType, encryption) {
+		writeError(w, http.StatusUnprocessableEntity, "poster_unavailable", "a poster cannot be extracted from the video")
+		return
+	}
+	metadata, err := requestMetadata(r.Header)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_metadata", err.Error())
+		return
+	}
+	lock, hints, tags, ok := requestRetention(w, r)
+	if !ok {
+		return
+	}
+	ctx := r.Context()
+	session := session{
+		ID:             uuid.New().String(),
+		Bucket:         resolveBucket(request.ContentType),
+		Key:            keyPrefix(r) + newKey(request.ContentType),
+		ExpiresAt:      time.Now().Add(sessionTTL),
+		ContentType:    request.ContentType,
+		Metadata:       metadata,
+		LifecycleHints: hints,
+		Tags:           tags,
+	}
+	session.setEncryption(r, encryption)
+	multipartUploadOutput, err := storage.CreateUpload(ctx, newCreateMultipartUploadInput(session.Bucket, session.Key, request.ContentType,
+		withEncryption(encryption),
+		withObjectLock(lock),
+		withStorageClass(defaultStorageClass),
+		withTags(hints, tags),
+		withMetadata(metadata),
+	))
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	session.UploadID = *multipartUploadOutput.UploadId
+	if err := uploadStore.Put(ctx, session); err != nil {
+		abortMultipartUpload(ctx, multipartUploadOutput)
+		writeS3Error(w, r, err)
+		return
+	}
+	writeSession(w, http.StatusCreated, uploadsPath, session, []SessionPart{})
+}
+
+// putUploadPart uploads the request body as a part of the session's multipart upload and
+// extends the session. Sending a part again replaces it. Parts are limited to PART_SIZE, as each
+// one is buffered whole before it is uploaded.
+func putUploadPart(w http.ResponseWriter, r *http.Request, session session, partNumber int32) {
+	if r.ContentLength < 1 {
+		writeError(w, http.StatusLengthRequired, "length_required", "parts need a Content-Length")
+		return
+	}
+	if r.ContentLength > partSize || r.ContentLength > maxContentSize {
+		writeError(w, http.StatusRequestEntityTooLarge, "entity_too_large", fmt.Sprintf("parts may not exceed %d bytes", partSize))
+		return
+	}
+	encryption, err := sessionEncryption(r, session)
+	if err != nil {
+		writeEncryptionError(w, err)
+		return
+	}
+	ctx := r.Context()
+	var body io.Reader = r.Body
+	// The first part must look like the declared type, the sniffed bytes are still uploaded.
+	if partNumber == 1 {
+		var sniffed string
+		var err error
+		sniffed, body, err = sniffBody(r.Body)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		if !matchesSniffed(session.ContentType, sniffed, contentTypes["/api/v1/file"]) {
+			logEntry(r.Context(), logLevelInfo, "content type mismatch", "declared", session.ContentType, "sniffed", sniffed)
+			writeError(w, http.StatusUnsupportedMediaType, "unsupported_media_type", "contents do not match the content type")
+			return
+		}
+	}
+	deadline := withDeadline(throttle(ctx, body))
+	partReader, err := newPartReader(partReaderStrategy, deadline, r.ContentLength)
+	if errors.Is(err, errUploadDuration) {
+		logEntry(r.Context(), logLevelInfo, "upload cut off", "error", err, "bytes", deadline.n)
+		writeUploadDuration(w)
+		return
+	} else if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	defer partReader.Close()
+	part, err := partReader.NextPart()
+	defer part.Release()
+	if errors.Is(err, errUploadDuration) {
+		logEntry(r.Context(), logLevelInfo, "upload cut off", "error", err, "bytes", deadline.n)
+		writeUploadDuration(w)
+		return
+	} else if err != nil || part.Size != r.ContentLength {
+		logEntry(r.Context(), logLevelError, "reading part failed", "error", err)
+		writeError(w, http.StatusBadRequest, "incomplete_part", "the part is shorter than its Content-Length")
+		return
+	}
+	partMD5, err := contentMD5(part.Body)
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	uploadPartOutput, err := uploadPartWithRetries(ctx, &s3.UploadPartInput{
+		Bucket:               aws.String(session.Bucket),
+		Key:                  aws.String(session.Key),
+		PartNumber:           partNumber,
+		UploadId:             aws.String(session.UploadID),
+		Body:                 part.Body,
+		ContentLength:        part.Size,
+		ContentMD5:           aws.String(partMD5),
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	if err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	session.ExpiresAt = time.Now().Add(sessionTTL)
+	if err := uploadStore.Put(ctx, session); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(SessionPart{
+		PartNumber: partNumber,
+		ETag:       aws.ToString(uploadPartOutput.ETag),
+		Size:       part.Size,
+	}); err != nil {
+		logEntry(r.Context(), logLevelError, "writing response failed", "error", err)
+	}
+}
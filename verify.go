@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"log"
+)
+
+// verifyReadable makes uploads confirm with HeadObject that the completed object can be read
+// before reporting success. It costs a request and some latency per upload.
+var verifyReadable bool
+
+// checkReadable fails when the object cannot be read back. The object is then deleted, since
+// the client is told the upload failed.
+func checkReadable(ctx context.Context, bucket, key string, encryption encryption) error {
+	_, err := client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(bucket),
+		Key:                  aws.String(key),
+		SSECustomerAlgorithm: encryption.customerAlgorithm,
+		SSECustomerKey:       encryption.customerKey,
+		SSECustomerKeyMD5:    encryption.customerKeyMD5,
+	})
+	if err == nil {
+		return nil
+	}
+	if _, deleteErr := client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}); deleteErr != nil {
+		log.Print(deleteErr)
+	}
+	return err
+}